@@ -6,7 +6,9 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/authzed/connector-postgresql/pkg/cmd/importer"
+	"github.com/authzed/connector-postgresql/pkg/cmd/reconcile"
 	"github.com/authzed/connector-postgresql/pkg/cmd/run"
+	"github.com/authzed/connector-postgresql/pkg/cmd/verify"
 	"github.com/authzed/connector-postgresql/pkg/signals"
 	"github.com/authzed/connector-postgresql/pkg/streams"
 )
@@ -22,7 +24,9 @@ func main() {
 
 	rootCmd.AddCommand(run.NewRunCmd(ctx, s))
 	rootCmd.AddCommand(importer.NewImportCmd(ctx, s))
+	rootCmd.AddCommand(reconcile.NewReconcileCmd(ctx, s))
+	rootCmd.AddCommand(verify.NewVerifyCmd(ctx, s))
 	if err := rootCmd.ExecuteContext(ctx); err != nil {
-		log.Fatal().Err(err)
+		log.Fatal().Err(err).Msg("exiting")
 	}
 }
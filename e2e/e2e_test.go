@@ -3,11 +3,17 @@ package e2e
 import (
 	"context"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
 
 	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -17,8 +23,12 @@ import (
 	"sigs.k8s.io/yaml"
 
 	"github.com/authzed/connector-postgresql/pkg/cmd/importer"
+	reconcilecmd "github.com/authzed/connector-postgresql/pkg/cmd/reconcile"
 	"github.com/authzed/connector-postgresql/pkg/cmd/run"
+	"github.com/authzed/connector-postgresql/pkg/cmd/verify"
+	"github.com/authzed/connector-postgresql/pkg/reconcile"
 	"github.com/authzed/connector-postgresql/pkg/streams"
+	"github.com/authzed/connector-postgresql/pkg/util"
 )
 
 //go:embed fixtures/generated_config.yaml
@@ -43,6 +53,12 @@ func TestSchemaReflection(t *testing.T) {
 	go func() {
 		testpool, err := pgxpool.Connect(context.Background(), connString)
 		require.NoError(err)
+
+		// dropping a column makes column numbers differ from positions in
+		// the replication log
+		_, err = testpool.Exec(context.Background(), `ALTER TABLE contacts DROP COLUMN phone;`)
+		require.NoError(err)
+
 		for i := 0; i < 3; i++ {
 			time.Sleep(1 * time.Second)
 			_, err = testpool.Exec(context.Background(), fmt.Sprintf(`
@@ -51,6 +67,12 @@ func TestSchemaReflection(t *testing.T) {
 			`, i))
 			require.NoError(err)
 
+			_, err = testpool.Exec(context.Background(), fmt.Sprintf(`
+				 UPDATE contacts SET customer_id=1, customer_name='BigCo'
+				 WHERE contact_name='Jeshk Doe %d';
+			`, i))
+			require.NoError(err)
+
 			_, err = testpool.Exec(context.Background(), fmt.Sprintf(`
 				INSERT INTO tags(tag_value)
 				VALUES('new_genre_%d');
@@ -69,6 +91,58 @@ func TestSchemaReflection(t *testing.T) {
 	require.NoError(o.Run(ctx))
 }
 
+func TestFollowUpdate(t *testing.T) {
+	// connector-postgresql run --dry-run=false <spicedb config> --config=path/to/config.yaml psql://whatever
+	require := require.New(t)
+	pg, port := postgres(t, "postgres:secret", 5432)
+	connString := newTestDB(t, pg, "postgres:secret", port)
+	spiceClient := spicedb(t)
+
+	o := run.NewOptions(streams.NewStdIO())
+	o.PostgresURI = connString
+	o.AppendSchema = true
+	o.DryRun = false
+	o.Client = spiceClient
+	require.NoError(yaml.Unmarshal(exampleUserConfig, &o.Config))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(o.Complete(ctx, []string{connString}))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- o.Run(ctx)
+	}()
+
+	contact := &v1.RelationshipFilter{ResourceType: "contact", OptionalResourceId: "3", OptionalRelation: "customer"}
+	eventuallyRelationships(t, spiceClient, contact, "contact:3#customer@customer:2_SmallFry")
+
+	testpool, err := pgxpool.Connect(context.Background(), connString)
+	require.NoError(err)
+	defer testpool.Close()
+
+	// contacts has the default replica identity, so the old customer is not
+	// in the replication log
+	_, err = testpool.Exec(context.Background(), `
+		UPDATE contacts SET customer_id=1, customer_name='BigCo'
+		WHERE contact_id=3;
+	`)
+	require.NoError(err)
+	eventuallyRelationships(t, spiceClient, contact, "contact:3#customer@customer:1_BigCo")
+
+	// updating an unmapped column keeps the relationship
+	_, err = testpool.Exec(context.Background(), `UPDATE contacts SET email='jeshk@bigco.dev' WHERE contact_id=3;`)
+	require.NoError(err)
+	_, err = testpool.Exec(context.Background(), `DELETE FROM contacts WHERE contact_id=1;`)
+	require.NoError(err)
+	eventuallyRelationships(t, spiceClient, &v1.RelationshipFilter{ResourceType: "contact", OptionalRelation: "customer"},
+		"contact:2#customer@customer:1_BigCo",
+		"contact:3#customer@customer:1_BigCo",
+	)
+
+	cancel()
+	require.NoError(<-errs)
+}
+
 func TestImportAuto(t *testing.T) {
 	// connector-postgresql import --dry-run=false <spicedb config> psql://whatever
 	require := require.New(t)
@@ -132,3 +206,161 @@ func TestImportUserProvidedConfig(t *testing.T) {
 	require.NoError(o.Run(context.Background()))
 	fmt.Println(ioout.String())
 }
+
+func TestImportConcurrent(t *testing.T) {
+	// connector-postgresql import --import-concurrency=4 --import-key-ranges=2 <spicedb config> --config-path=path/to/config.json psql://whatever
+	require := require.New(t)
+	pg, port := postgres(t, "postgres:secret", 5432)
+	connString := newTestDB(t, pg, "postgres:secret", port)
+	spiceClient := spicedb(t)
+
+	testIO, _, _, _ := streams.NewTestIO()
+	o := importer.NewOptions(testIO)
+	o.PostgresURI = connString
+	o.AppendSchema = true
+	o.DryRun = false
+	o.ImportConcurrency = 4
+	o.ImportKeyRanges = 2
+	o.MaxInflightWrites = 2
+	require.NoError(yaml.Unmarshal(exampleUserConfig, &o.Config))
+	o.Client = spiceClient
+	require.NoError(o.Complete(context.Background(), []string{connString}))
+	require.NoError(o.Run(context.Background()))
+
+	require.Equal(3, countRelationships(t, spiceClient, "article", "tags"))
+	require.Equal(3, countRelationships(t, spiceClient, "tags", "article"))
+}
+
+func TestReconcile(t *testing.T) {
+	// connector-postgresql reconcile --dry-run=false <spicedb config> --config-path=path/to/config.json psql://whatever
+	require := require.New(t)
+	pg, port := postgres(t, "postgres:secret", 5432)
+	connString := newTestDB(t, pg, "postgres:secret", port)
+	spiceClient := spicedb(t)
+
+	testIO, _, _, _ := streams.NewTestIO()
+	o := importer.NewOptions(testIO)
+	o.PostgresURI = connString
+	o.AppendSchema = true
+	o.DryRun = false
+	require.NoError(yaml.Unmarshal(exampleUserConfig, &o.Config))
+	o.Client = spiceClient
+	require.NoError(o.Complete(context.Background(), []string{connString}))
+	require.NoError(o.Run(context.Background()))
+
+	testpool, err := pgxpool.Connect(context.Background(), connString)
+	require.NoError(err)
+	defer testpool.Close()
+	_, err = testpool.Exec(context.Background(), `DELETE FROM article_tag WHERE article_id = 2;`)
+	require.NoError(err)
+
+	reconcileIO, _, reconcileOut, _ := streams.NewTestIO()
+	ro := reconcilecmd.NewOptions(reconcileIO)
+	ro.PostgresURI = connString
+	ro.DryRun = true
+	require.NoError(yaml.Unmarshal(exampleUserConfig, &ro.Config))
+	ro.Client = spiceClient
+	require.NoError(ro.Complete(context.Background(), []string{connString}))
+	require.NoError(ro.Run(context.Background()))
+	require.Contains(reconcileOut.String(), "- article:2#tags@tags:2")
+	require.Contains(reconcileOut.String(), "- tags:2#article@article:2")
+	require.Equal(3, countRelationships(t, spiceClient, "article", "tags"))
+
+	ro.DryRun = false
+	require.NoError(ro.Complete(context.Background(), []string{connString}))
+	require.NoError(ro.Run(context.Background()))
+	require.Equal(2, countRelationships(t, spiceClient, "article", "tags"))
+	require.Equal(2, countRelationships(t, spiceClient, "tags", "article"))
+}
+
+func TestVerify(t *testing.T) {
+	// connector-postgresql verify --output=json <spicedb config> --config-path=path/to/config.json psql://whatever
+	require := require.New(t)
+	pg, port := postgres(t, "postgres:secret", 5432)
+	connString := newTestDB(t, pg, "postgres:secret", port)
+	spiceClient := spicedb(t)
+
+	testIO, _, _, _ := streams.NewTestIO()
+	o := importer.NewOptions(testIO)
+	o.PostgresURI = connString
+	o.AppendSchema = true
+	o.DryRun = false
+	require.NoError(yaml.Unmarshal(exampleUserConfig, &o.Config))
+	o.Client = spiceClient
+	require.NoError(o.Complete(context.Background(), []string{connString}))
+	require.NoError(o.Run(context.Background()))
+
+	verifyIO, _, _, _ := streams.NewTestIO()
+	vo := verify.NewOptions(verifyIO)
+	vo.PostgresURI = connString
+	vo.Output = verify.OutputJSON
+	require.NoError(yaml.Unmarshal(exampleUserConfig, &vo.Config))
+	vo.Client = spiceClient
+	require.NoError(vo.Complete(context.Background(), []string{connString}))
+	require.NoError(vo.Run(context.Background()))
+
+	testpool, err := pgxpool.Connect(context.Background(), connString)
+	require.NoError(err)
+	defer testpool.Close()
+	_, err = testpool.Exec(context.Background(), `DELETE FROM article_tag WHERE article_id = 2;`)
+	require.NoError(err)
+
+	verifyIO, _, verifyOut, _ := streams.NewTestIO()
+	vo.IO = verifyIO
+	require.ErrorIs(vo.Run(context.Background()), verify.ErrDrift)
+	var report reconcile.Report
+	require.NoError(json.Unmarshal(verifyOut.Bytes(), &report))
+	require.False(report.InSync)
+	require.Contains(verifyOut.String(), `"article:2#tags@tags:2"`)
+}
+
+func countRelationships(t *testing.T, client *authzed.Client, resourceType, relation string) int {
+	rels, err := readRelationships(client, &v1.RelationshipFilter{
+		ResourceType:     resourceType,
+		OptionalRelation: relation,
+	})
+	require.NoError(t, err)
+	return len(rels)
+}
+
+// readRelationships returns the relationships that match the filter as
+// strings. It doesn't fail the test itself, so that it can be polled from
+// require.Eventually.
+func readRelationships(client *authzed.Client, filter *v1.RelationshipFilter) ([]string, error) {
+	stream, err := client.ReadRelationships(context.Background(), &v1.ReadRelationshipsRequest{
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true},
+		},
+		RelationshipFilter: filter,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rels := make([]string, 0)
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			sort.Strings(rels)
+			return rels, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rels = append(rels, util.RelString(resp.Relationship))
+	}
+}
+
+// eventuallyRelationships waits until the relationships that match the filter
+// are want
+func eventuallyRelationships(t *testing.T, client *authzed.Client, filter *v1.RelationshipFilter, want ...string) {
+	sort.Strings(want)
+	var got []string
+	require.Eventually(t, func() bool {
+		rels, err := readRelationships(client, filter)
+		if err != nil {
+			return false
+		}
+		got = rels
+		return reflect.DeepEqual(got, want)
+	}, 30*time.Second, 100*time.Millisecond, "want %v", want)
+}
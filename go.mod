@@ -5,13 +5,16 @@ go 1.16
 require (
 	github.com/authzed/authzed-go v0.2.0
 	github.com/authzed/grpcutil v0.0.0-20210914195113-c0d8369e7e1f
+	github.com/cenkalti/backoff/v4 v4.1.1
 	github.com/jackc/pgconn v1.10.0
 	github.com/jackc/pglogrepl v0.0.0-20210731151948-9f1effd582c4
 	github.com/jackc/pgproto3/v2 v2.1.1
 	github.com/jackc/pgx/v4 v4.13.0
 	github.com/jzelinskie/cobrautil v0.0.7
+	github.com/prometheus/client_golang v1.11.0
 	github.com/rs/zerolog v1.26.0
 	github.com/spf13/cobra v1.2.1
+	github.com/stretchr/testify v1.7.0
 	google.golang.org/grpc v1.42.0
 )
 
@@ -3,23 +3,32 @@ package cache
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/authzed/authzed-go/proto/authzed/api/v1"
-)
+	"github.com/jackc/pglogrepl"
 
-// TODO: metrics
-// TODO: store xlogpos
-// TODO: fix deletion
+	"github.com/authzed/connector-postgresql/pkg/metrics"
+	"github.com/authzed/connector-postgresql/pkg/util"
+)
 
-// Cache stores operations fetched from the WAL that need to be transformed
-// and synced to SpiceDB. It is safe to use from multiple threads.
+// Cache stores transactions fetched from the WAL that need to be synced to
+// SpiceDB. Transactions are returned by Next in the order they were committed
+// in postgres. It is safe to use from multiple threads, but Next should only
+// be called from one.
+// The cache also tracks which positions in the WAL have been received and
+// which have been applied to SpiceDB, so that postgres is only told to
+// release WAL once it is no longer needed.
 type Cache struct {
 	sync.Mutex
 	sync.Cond
 	ctx context.Context
 
-	queue []string
-	rels  map[string]*Operation
+	queue     []*Transaction
+	inflight  *Transaction
+	received  pglogrepl.LSN
+	committed pglogrepl.LSN
+	closed    bool
 }
 
 // OperationType stores what needs to happen to the relationships in the cache
@@ -61,13 +70,159 @@ type Operation struct {
 	Rel    *v1.Relationship
 }
 
+// Transaction holds the operations generated by a single postgres
+// transaction, so that they can be applied to SpiceDB together. It is not
+// safe to use from multiple threads.
+type Transaction struct {
+	// BeginLSN is the position in the WAL where the transaction started
+	BeginLSN pglogrepl.LSN
+	// CommitLSN is the position in the WAL of the transaction's commit
+	CommitLSN pglogrepl.LSN
+	// CommitTime is when the transaction was committed in postgres
+	CommitTime time.Time
+
+	// keys holds the relationships that are updated, in the order they were
+	// first updated, and ops the last operation on each of them
+	keys []string
+	ops  map[string]*Operation
+	// filters are deletes by filter. They are resolved into deletes of the
+	// relationships that match them when the transaction is applied, so
+	// that the whole transaction can be written in one request.
+	filters []*v1.RelationshipFilter
+	// truncates are deletes by filter that can match any number of
+	// relationships. They are sent to SpiceDB as they are, before the rest
+	// of the transaction.
+	truncates []*v1.RelationshipFilter
+	// queued is when the transaction was committed to the cache
+	queued time.Time
+}
+
+// ReadFunc returns the relationships in SpiceDB that match a filter
+type ReadFunc func(context.Context, *v1.RelationshipFilter) ([]*v1.Relationship, error)
+
+// NewTransaction returns an empty transaction that starts at beginLSN
+func NewTransaction(beginLSN pglogrepl.LSN) *Transaction {
+	return &Transaction{
+		BeginLSN: beginLSN,
+		keys:     make([]string, 0),
+		ops:      make(map[string]*Operation, 0),
+		filters:  make([]*v1.RelationshipFilter, 0),
+	}
+}
+
+// Touch adds a touch of the relationship to the transaction. It replaces any
+// earlier operation on the same relationship.
+func (t *Transaction) Touch(rel *v1.Relationship) {
+	t.add(OperationTypeTouch, rel)
+}
+
+// Delete adds a delete of the relationship to the transaction. It replaces
+// any earlier operation on the same relationship; the relationship may already
+// exist in spicedb, so a delete never simply cancels out a touch.
+func (t *Transaction) Delete(rel *v1.Relationship) {
+	t.add(OperationTypeDelete, rel)
+}
+
+// DeleteMatching adds a delete of every relationship that matches the filter
+// to the transaction. Relationships that were touched earlier in the
+// transaction are deleted if they match, ones touched later are kept.
+func (t *Transaction) DeleteMatching(filter *v1.RelationshipFilter) {
+	for _, op := range t.ops {
+		if util.FilterMatches(filter, op.Rel) {
+			op.OpType = OperationTypeDelete
+		}
+	}
+	t.filters = append(t.filters, filter)
+}
+
+// Truncate adds a delete of every relationship that matches the filter to the
+// transaction, like DeleteMatching, but without reading the relationships
+// from SpiceDB: the filter is applied by SpiceDB before the rest of the
+// transaction, see Truncates. Operations added earlier that match the filter
+// are dropped, since the filter deletes them anyway.
+func (t *Transaction) Truncate(filter *v1.RelationshipFilter) {
+	keys := make([]string, 0, len(t.keys))
+	for _, key := range t.keys {
+		if util.FilterMatches(filter, t.ops[key].Rel) {
+			delete(t.ops, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	t.keys = keys
+	t.truncates = append(t.truncates, filter)
+}
+
+// Truncates returns the filters added with Truncate, which must be applied
+// in order, before the updates returned by Updates.
+func (t *Transaction) Truncates() []*v1.RelationshipFilter {
+	return t.truncates
+}
+
+func (t *Transaction) add(opType OperationType, rel *v1.Relationship) {
+	key := util.RelString(rel)
+	if op, ok := t.ops[key]; ok {
+		op.OpType = opType
+		return
+	}
+	t.ops[key] = &Operation{OpType: opType, Rel: rel}
+	t.keys = append(t.keys, key)
+}
+
+// Len returns the number of (distinct) operations in the transaction
+func (t *Transaction) Len() int {
+	return len(t.keys) + len(t.filters) + len(t.truncates)
+}
+
+// Updates returns the transaction's operations as relationship updates that
+// can be written to SpiceDB in one request, with each relationship updated at
+// most once. Deletes by filter are resolved with read, which must return the
+// relationships as they are after the transaction's Truncates have been
+// applied, and before the rest of the transaction is. Relationships
+// that match a filter but are touched after it are left alone, since they
+// already exist.
+func (t *Transaction) Updates(ctx context.Context, read ReadFunc) ([]*v1.RelationshipUpdate, error) {
+	updates := make([]*v1.RelationshipUpdate, 0, len(t.keys))
+	existing := make(map[string]struct{}, 0)
+	for _, filter := range t.filters {
+		rels, err := read(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range rels {
+			key := util.RelString(rel)
+			if _, ok := existing[key]; ok {
+				continue
+			}
+			existing[key] = struct{}{}
+			if _, ok := t.ops[key]; ok {
+				continue
+			}
+			updates = append(updates, &v1.RelationshipUpdate{
+				Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
+				Relationship: rel,
+			})
+		}
+	}
+	for _, key := range t.keys {
+		op := t.ops[key]
+		if _, ok := existing[key]; ok && op.OpType == OperationTypeTouch {
+			continue
+		}
+		updates = append(updates, &v1.RelationshipUpdate{
+			Operation:    op.OpType.RelationshipUpdateOpType(),
+			Relationship: op.Rel,
+		})
+	}
+	return updates, nil
+}
+
 // NewCache returns a new cache tied to the lifetime of the context.
 // The cache can be closed by cancelling the context.
 // Calling NewCache spawns a goroutine to handle cancellation.
 func NewCache(ctx context.Context) *Cache {
 	c := Cache{
-		rels:  make(map[string]*Operation, 0),
-		queue: make([]string, 0),
+		queue: make([]*Transaction, 0),
 		ctx:   ctx,
 	}
 	// the cache's mutex also serves as the sync.Cond locker
@@ -82,80 +237,163 @@ func NewCache(ctx context.Context) *Cache {
 	return &c
 }
 
-// Touch puts a new touch event in the cache for the relationship
-func (c *Cache) Touch(rel *v1.Relationship) {
-	key := rel.String()
+// Commit puts a committed transaction in the queue. Empty transactions are
+// dropped.
+func (c *Cache) Commit(txn *Transaction) {
+	if txn.Len() == 0 {
+		return
+	}
 	c.Lock()
 	defer c.Unlock()
 	defer c.Broadcast()
 
-	op, ok := c.rels[key]
-	if ok {
-		op.OpType = OperationTypeTouch
-		return
+	txn.queued = time.Now()
+	c.queue = append(c.queue, txn)
+	c.updateMetrics()
+}
+
+// Requeue puts back a transaction that failed to apply. It is put at the
+// front of the queue, since later transactions may depend on it.
+func (c *Cache) Requeue(txn *Transaction) {
+	c.Lock()
+	defer c.Unlock()
+	defer c.Broadcast()
+
+	if c.inflight == txn {
+		c.inflight = nil
+	}
+	c.queue = append([]*Transaction{txn}, c.queue...)
+	metrics.CacheRequeues.Inc()
+	c.updateMetrics()
+}
+
+// Done marks a transaction returned by Next as applied
+func (c *Cache) Done(txn *Transaction) {
+	c.Lock()
+	defer c.Unlock()
+	if c.inflight == txn {
+		c.inflight = nil
+	}
+	if txn.CommitLSN > c.committed {
+		c.committed = txn.CommitLSN
+	}
+	if !txn.CommitTime.IsZero() {
+		metrics.LagSeconds.Set(time.Since(txn.CommitTime).Seconds())
+	}
+	c.updateMetrics()
+}
+
+// Received records that everything in the WAL up to lsn has been added to
+// the cache. It must not be called while a transaction that has been read
+// from the WAL has not been committed to the cache yet.
+func (c *Cache) Received(lsn pglogrepl.LSN) {
+	c.Lock()
+	defer c.Unlock()
+	if lsn > c.received {
+		c.received = lsn
 	}
-	c.rels[key] = &Operation{OpType: OperationTypeTouch, Rel: rel}
-	c.queue = append(c.queue, key)
+	c.updateMetrics()
 }
 
-// TODO: WARNING: DELETEs need to be handled differently
+// LastReceived returns the last position recorded with Received. Everything
+// before it is either queued, in flight, or applied.
+func (c *Cache) LastReceived() pglogrepl.LSN {
+	c.Lock()
+	defer c.Unlock()
+	return c.received
+}
 
-// Delete puts a new delete event in the cache for the relationship
-func (c *Cache) Delete(rel *v1.Relationship) {
-	key := rel.String()
+// Applied returns the position in the WAL up to which every change has been
+// applied to SpiceDB. This is the start of the oldest transaction that is
+// still queued or in flight, or the last received position if there are
+// none.
+func (c *Cache) Applied() pglogrepl.LSN {
 	c.Lock()
 	defer c.Unlock()
+	return c.applied()
+}
 
-	// if the tuple is deleted before it's popped, we can just remove it
-	// from the queue
-	if _, ok := c.rels[key]; ok {
-		delete(c.rels, key)
-		return
+func (c *Cache) applied() pglogrepl.LSN {
+	if c.inflight != nil {
+		return c.inflight.BeginLSN
+	}
+	if len(c.queue) > 0 {
+		return c.queue[0].BeginLSN
+	}
+	return c.received
+}
+
+// OldestPending returns when the oldest transaction that is queued or in
+// flight was committed to the cache, or the zero time if there is none
+func (c *Cache) OldestPending() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	if c.inflight != nil {
+		return c.inflight.queued
+	}
+	if len(c.queue) > 0 {
+		return c.queue[0].queued
 	}
-	c.rels[key] = &Operation{OpType: OperationTypeDelete, Rel: rel}
-	c.queue = append(c.queue, key)
+	return time.Time{}
+}
+
+// Committed returns the commit position of the last transaction that was
+// applied to SpiceDB
+func (c *Cache) Committed() pglogrepl.LSN {
+	c.Lock()
+	defer c.Unlock()
+	return c.committed
+}
+
+// Close marks the cache as complete: no more transactions will be
+// committed. Next keeps returning the transactions that are still queued, and
+// returns nil once the queue is empty.
+func (c *Cache) Close() {
+	c.Lock()
+	defer c.Unlock()
+	defer c.Broadcast()
+	c.closed = true
 }
 
-// Requeue re-adds a key that failed to apply
-// It is handled differently from normal additions to the queue. A delete added
-// to a cache with a touch would normally cancel both out, but a requeued delete
-// may still need to delete the relationship in the backing spicedb.
-func (c *Cache) Requeue(op OperationType, rel *v1.Relationship) {
-	key := rel.String()
+// Len returns the number of transactions that are queued or in flight
+func (c *Cache) Len() int {
 	c.Lock()
 	defer c.Unlock()
+	return c.len()
+}
 
-	// if it exists, overwrite the operation
-	if _, ok := c.rels[key]; ok {
-		c.rels[key].OpType = op
+func (c *Cache) len() int {
+	if c.inflight != nil {
+		return len(c.queue) + 1
 	}
-	c.rels[key] = &Operation{OpType: op, Rel: rel}
-	c.queue = append(c.queue, key)
+	return len(c.queue)
 }
 
-// Next returns the next relationship in the queue
-// it blocks until an item is added if the queue is empty and returns nil only
-// when stopped via the context
-func (c *Cache) Next() *Operation {
+// Next returns the next transaction in the queue
+// it blocks until a transaction is added if the queue is empty and returns nil
+// only when stopped via the context, or when the cache has been closed and
+// drained. Transactions returned by Next must be marked as Done or Requeued
+// before Next is called again.
+func (c *Cache) Next() *Transaction {
 	c.Lock()
 	defer c.Unlock()
-	for {
-		if len(c.queue) == 0 {
-			// wait until there are more items in the queue
-			c.Wait()
-		}
-		// exit if the context has been cancelled
-		if c.ctx.Err() != nil {
-			return nil
-		}
-		key := c.queue[0]
-		c.queue = c.queue[1:]
-		rel, ok := c.rels[key]
-		if !ok {
-			// rel was deleted, check next in queue
-			continue
-		}
-		delete(c.rels, key)
-		return rel
+	for len(c.queue) == 0 && !c.closed && c.ctx.Err() == nil {
+		// wait until there are more items in the queue
+		c.Wait()
+	}
+	// exit if the context has been cancelled or there's nothing left
+	if c.ctx.Err() != nil || len(c.queue) == 0 {
+		return nil
 	}
+	txn := c.queue[0]
+	c.queue = c.queue[1:]
+	c.inflight = txn
+	return txn
+}
+
+// updateMetrics reports the cache's state, it must be called with the lock held
+func (c *Cache) updateMetrics() {
+	metrics.CacheQueueDepth.Set(float64(c.len()))
+	metrics.LSN.WithLabelValues(metrics.PositionReceived).Set(float64(c.received))
+	metrics.LSN.WithLabelValues(metrics.PositionApplied).Set(float64(c.applied()))
 }
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/require"
+
+	"github.com/authzed/connector-postgresql/pkg/util"
+)
+
+func rel(resourceID, subjectID string) *v1.Relationship {
+	return &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: "contact", ObjectId: resourceID},
+		Relation: "customer",
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "customer", ObjectId: subjectID}},
+	}
+}
+
+func contactFilter(resourceID string) *v1.RelationshipFilter {
+	return &v1.RelationshipFilter{
+		ResourceType:       "contact",
+		OptionalResourceId: resourceID,
+		OptionalRelation:   "customer",
+	}
+}
+
+func TestTransactionUpdates(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []*v1.Relationship
+		build    func(*Transaction)
+		want     []string
+	}{
+		{
+			name: "touch and delete",
+			build: func(txn *Transaction) {
+				txn.Touch(rel("1", "a"))
+				txn.Delete(rel("2", "a"))
+			},
+			want: []string{"touch contact:1#customer@customer:a", "delete contact:2#customer@customer:a"},
+		},
+		{
+			name:     "unchanged update writes nothing",
+			existing: []*v1.Relationship{rel("1", "a")},
+			build: func(txn *Transaction) {
+				txn.DeleteMatching(contactFilter("1"))
+				txn.Touch(rel("1", "a"))
+			},
+			want: []string{},
+		},
+		{
+			name:     "moved relationship",
+			existing: []*v1.Relationship{rel("1", "a")},
+			build: func(txn *Transaction) {
+				txn.DeleteMatching(contactFilter("1"))
+				txn.Touch(rel("1", "b"))
+			},
+			want: []string{"delete contact:1#customer@customer:a", "touch contact:1#customer@customer:b"},
+		},
+		{
+			name: "filter deletes earlier touch",
+			build: func(txn *Transaction) {
+				txn.Touch(rel("1", "a"))
+				txn.DeleteMatching(contactFilter("1"))
+			},
+			want: []string{"delete contact:1#customer@customer:a"},
+		},
+		{
+			name:     "filter doesn't match other resources",
+			existing: []*v1.Relationship{rel("1", "a"), rel("2", "a")},
+			build: func(txn *Transaction) {
+				txn.DeleteMatching(contactFilter("2"))
+			},
+			want: []string{"delete contact:2#customer@customer:a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			read := func(ctx context.Context, filter *v1.RelationshipFilter) ([]*v1.Relationship, error) {
+				matches := make([]*v1.Relationship, 0)
+				for _, r := range tt.existing {
+					if util.FilterMatches(filter, r) {
+						matches = append(matches, r)
+					}
+				}
+				return matches, nil
+			}
+			txn := NewTransaction(0)
+			tt.build(txn)
+			updates, err := txn.Updates(context.Background(), read)
+			require.NoError(t, err)
+			got := make([]string, 0, len(updates))
+			for _, u := range updates {
+				op := OperationTypeTouch
+				if u.Operation == v1.RelationshipUpdate_OPERATION_DELETE {
+					op = OperationTypeDelete
+				}
+				got = append(got, op.String()+" "+util.RelString(u.Relationship))
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTransactionTruncate(t *testing.T) {
+	truncate := &v1.RelationshipFilter{ResourceType: "contact", OptionalRelation: "customer"}
+	txn := NewTransaction(0)
+	txn.Touch(rel("1", "a"))
+	txn.Touch(&v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: "article", ObjectId: "1"},
+		Relation: "tags",
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "tags", ObjectId: "x"}},
+	})
+	txn.Truncate(truncate)
+	txn.Touch(rel("2", "a"))
+
+	require.Equal(t, []*v1.RelationshipFilter{truncate}, txn.Truncates())
+	require.Equal(t, 3, txn.Len())
+
+	// the relationships are read after the truncate, so none match
+	read := func(ctx context.Context, filter *v1.RelationshipFilter) ([]*v1.Relationship, error) {
+		return nil, nil
+	}
+	updates, err := txn.Updates(context.Background(), read)
+	require.NoError(t, err)
+	got := make([]string, 0, len(updates))
+	for _, u := range updates {
+		got = append(got, util.RelString(u.Relationship))
+	}
+	require.Equal(t, []string{"article:1#tags@tags:x", "contact:2#customer@customer:a"}, got)
+}
+
+func committedTxn(begin, commit pglogrepl.LSN) *Transaction {
+	txn := NewTransaction(begin)
+	txn.CommitLSN = commit
+	txn.Touch(rel(begin.String(), "a"))
+	return txn
+}
+
+func TestCachePositions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewCache(ctx)
+
+	c.Received(10)
+	require.Equal(t, pglogrepl.LSN(10), c.Applied())
+
+	// empty transactions are dropped and don't hold back the position
+	c.Commit(NewTransaction(10))
+	require.Equal(t, 0, c.Len())
+
+	first := committedTxn(20, 30)
+	second := committedTxn(40, 50)
+	c.Commit(first)
+	c.Commit(second)
+	c.Received(60)
+	require.Equal(t, pglogrepl.LSN(60), c.LastReceived())
+	require.Equal(t, 2, c.Len())
+	require.False(t, c.OldestPending().IsZero())
+
+	// nothing is applied past the start of the oldest pending transaction,
+	// whether it is queued or in flight
+	require.Equal(t, pglogrepl.LSN(20), c.Applied())
+	require.Same(t, first, c.Next())
+	require.Equal(t, pglogrepl.LSN(20), c.Applied())
+
+	// a requeued transaction is retried before later ones
+	c.Requeue(first)
+	require.Equal(t, pglogrepl.LSN(20), c.Applied())
+	require.Same(t, first, c.Next())
+	c.Done(first)
+	require.Equal(t, pglogrepl.LSN(40), c.Applied())
+	require.Equal(t, pglogrepl.LSN(30), c.Committed())
+
+	require.Same(t, second, c.Next())
+	c.Done(second)
+	require.Equal(t, pglogrepl.LSN(60), c.Applied())
+	require.Equal(t, pglogrepl.LSN(50), c.Committed())
+	require.Equal(t, 0, c.Len())
+	require.True(t, c.OldestPending().IsZero())
+
+	// positions never move backwards
+	c.Received(5)
+	require.Equal(t, pglogrepl.LSN(60), c.LastReceived())
+}
+
+func TestCacheClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewCache(ctx)
+	first := committedTxn(10, 20)
+	second := committedTxn(30, 40)
+	c.Commit(first)
+	c.Commit(second)
+
+	// a closed cache drains what is queued, and then stops blocking
+	c.Close()
+	require.Same(t, first, c.Next())
+	c.Done(first)
+	require.Same(t, second, c.Next())
+	c.Done(second)
+	require.Nil(t, c.Next())
+}
+
+func TestCacheCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewCache(ctx)
+
+	next := make(chan *Transaction)
+	go func() { next <- c.Next() }()
+	cancel()
+	select {
+	case txn := <-next:
+		require.Nil(t, txn)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Next didn't return when the context was cancelled")
+	}
+
+	// queued transactions are abandoned once the context is cancelled
+	c.Commit(committedTxn(10, 20))
+	require.Nil(t, c.Next())
+}
@@ -0,0 +1,113 @@
+package checkpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// Store persists the last WAL position that has been written to SpiceDB, so
+// that replication can be resumed from it after a restart.
+type Store interface {
+	// Load returns the stored position and whether one was found
+	Load(ctx context.Context) (pglogrepl.LSN, bool, error)
+	Save(ctx context.Context, lsn pglogrepl.LSN) error
+}
+
+// FileStore stores a checkpoint for a single replication slot in a file
+type FileStore struct {
+	path string
+	slot string
+}
+
+var _ Store = &FileStore{}
+
+// NewFileStore returns a Store that keeps the checkpoint for slot in the file
+// at path
+func NewFileStore(path, slot string) *FileStore {
+	return &FileStore{
+		path: path,
+		slot: slot,
+	}
+}
+
+type fileCheckpoint struct {
+	Slot string `json:"slot"`
+	LSN  string `json:"lsn"`
+}
+
+// Load reads the checkpoint from the file. A missing file, or a checkpoint
+// that was written for a different slot, is reported as not found.
+func (s *FileStore) Load(ctx context.Context) (pglogrepl.LSN, bool, error) {
+	contents, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	var c fileCheckpoint
+	if err := json.Unmarshal(contents, &c); err != nil {
+		return 0, false, err
+	}
+	if c.Slot != s.slot {
+		log.Warn().Str("file", s.path).Str("slot", c.Slot).Str("expected", s.slot).Msg("ignoring checkpoint for a different replication slot")
+		return 0, false, nil
+	}
+	lsn, err := pglogrepl.ParseLSN(c.LSN)
+	if err != nil {
+		return 0, false, err
+	}
+	return lsn, true, nil
+}
+
+// Save atomically replaces the checkpoint in the file
+func (s *FileStore) Save(ctx context.Context, lsn pglogrepl.LSN) error {
+	contents, err := json.Marshal(fileCheckpoint{Slot: s.slot, LSN: lsn.String()})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, contents)
+}
+
+// writeFileAtomic replaces the file at path with contents, so that readers
+// never see a partially written file
+func writeFileAtomic(path string, contents []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// DiscardingStore never finds a checkpoint and drops everything it's asked
+// to save. It is used with temporary slots, which can't be resumed.
+type DiscardingStore struct{}
+
+var _ Store = DiscardingStore{}
+
+func (s DiscardingStore) Load(ctx context.Context) (pglogrepl.LSN, bool, error) {
+	return 0, false, nil
+}
+
+func (s DiscardingStore) Save(ctx context.Context, lsn pglogrepl.LSN) error {
+	return nil
+}
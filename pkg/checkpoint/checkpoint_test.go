@@ -0,0 +1,90 @@
+package checkpoint
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	store := NewFileStore(path, "spicedb_sync_slot")
+
+	// a missing file is no checkpoint
+	_, found, err := store.Load(ctx)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	require.NoError(t, store.Save(ctx, pglogrepl.LSN(0x16B3748)))
+	require.NoError(t, store.Save(ctx, pglogrepl.LSN(0x16B37F0)))
+	lsn, found, err := store.Load(ctx)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, pglogrepl.LSN(0x16B37F0), lsn)
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"slot": "spicedb_sync_slot", "lsn": "0/16B37F0"}`, string(contents))
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// the checkpoint of another slot is ignored
+	_, found, err = NewFileStore(path, "other_slot").Load(ctx)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestFileStoreInvalid(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	store := NewFileStore(path, "spicedb_sync_slot")
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0o644))
+	_, _, err := store.Load(ctx)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"slot": "spicedb_sync_slot", "lsn": "nope"}`), 0o644))
+	_, _, err = store.Load(ctx)
+	require.Error(t, err)
+}
+
+func TestDiscardingStore(t *testing.T) {
+	ctx := context.Background()
+	require.NoError(t, DiscardingStore{}.Save(ctx, pglogrepl.LSN(1)))
+	_, found, err := DiscardingStore{}.Load(ctx)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestFileImportStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "import")
+	store := NewFileImportStore(path)
+
+	// a missing file is no progress
+	progress, err := store.Load(ctx)
+	require.NoError(t, err)
+	require.Empty(t, progress)
+
+	saved := ImportProgress{
+		"contacts:contact#owner@user":       {LastKey: []string{"10"}},
+		"contacts:contact#viewer@user":      {Done: true},
+		"contacts:contact#editor@user[1/2]": {RangeEnd: []string{"5"}, LastKey: []string{"3"}},
+	}
+	require.NoError(t, store.Save(ctx, saved))
+	progress, err = store.Load(ctx)
+	require.NoError(t, err)
+	require.Equal(t, saved, progress)
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0o644))
+	_, err = store.Load(ctx)
+	require.Error(t, err)
+}
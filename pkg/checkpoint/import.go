@@ -0,0 +1,72 @@
+package checkpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// ImportProgress records how far an import has got, for each table and
+// RowMapping
+type ImportProgress map[string]MappingProgress
+
+// MappingProgress is how far the import of a single table and RowMapping has
+// got
+type MappingProgress struct {
+	// LastKey is the primary key of the last row that has been written to
+	// SpiceDB, as text
+	LastKey []string `json:"last_key,omitempty"`
+	// Done is true once every row has been written
+	Done bool `json:"done,omitempty"`
+	// RangeEnd is the last primary key of the range of keys, as text, when
+	// the table is imported in ranges. It is empty for the last range.
+	RangeEnd []string `json:"range_end,omitempty"`
+}
+
+// ImportStore persists import progress, so that an interrupted import can be
+// resumed
+type ImportStore interface {
+	// Load returns the stored progress, which is empty if there is none
+	Load(ctx context.Context) (ImportProgress, error)
+	Save(ctx context.Context, progress ImportProgress) error
+}
+
+// FileImportStore stores import progress in a file
+type FileImportStore struct {
+	path string
+}
+
+var _ ImportStore = &FileImportStore{}
+
+// NewFileImportStore returns an ImportStore that keeps progress in the file
+// at path
+func NewFileImportStore(path string) *FileImportStore {
+	return &FileImportStore{path: path}
+}
+
+// Load reads the progress from the file. A missing file is no progress.
+func (s *FileImportStore) Load(ctx context.Context) (ImportProgress, error) {
+	progress := make(ImportProgress, 0)
+	contents, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// Save atomically replaces the progress in the file
+func (s *FileImportStore) Save(ctx context.Context, progress ImportProgress) error {
+	contents, err := json.MarshalIndent(progress, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, contents)
+}
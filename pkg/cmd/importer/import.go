@@ -2,14 +2,17 @@ package importer
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/jzelinskie/cobrautil"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 
+	"github.com/authzed/connector-postgresql/pkg/checkpoint"
 	"github.com/authzed/connector-postgresql/pkg/importer"
 	"github.com/authzed/connector-postgresql/pkg/options"
+	"github.com/authzed/connector-postgresql/pkg/pgschema"
 	"github.com/authzed/connector-postgresql/pkg/streams"
 	"github.com/authzed/connector-postgresql/pkg/util"
 	"github.com/authzed/connector-postgresql/pkg/write"
@@ -37,6 +40,11 @@ func NewImportCmd(ctx context.Context, streams streams.IO) *cobra.Command {
 	cmd.Flags().BoolVar(&o.DryRun, "dry-run", true, "print relationships that would be written to SpiceDB")
 	cmd.Flags().StringVar(&o.MappingFile, "config", "", "path to a file containing the config that maps between pg tables and spicedb relationships")
 	cmd.Flags().BoolVar(&o.AppendSchema, "append-schema", true, "append the config's (zed) schema to the schema in spicedb")
+	cmd.Flags().StringVar(&o.ImportCheckpointFile, "import-checkpoint-file", o.ImportCheckpointFile, "path to a file that records how far the import has got for each table, so that it can be resumed; progress is not recorded if empty or in dry-run mode")
+	cmd.Flags().BoolVar(&o.Resume, "resume", false, "continue an interrupted import from the import checkpoint file")
+	RegisterConcurrencyFlags(cmd, o)
+	RegisterBatchFlags(cmd, o)
+	RegisterRetryFlags(cmd, o)
 	cobrautil.RegisterZeroLogFlags(cmd.Flags(), "log")
 
 	return cmd
@@ -49,20 +57,76 @@ type Options struct {
 	options.SpiceDBOptions
 	options.ConfigOptions
 
-	DryRun       bool
-	AppendSchema bool
-
-	AppendSchemaWriter write.AppendSchemaWriter
-	RelationshipWriter write.RelationshipWriter
+	DryRun               bool
+	AppendSchema         bool
+	Resume               bool
+	ImportCheckpointFile string
+	ImportConcurrency    int
+	ImportKeyRanges      int
+	MaxInflightWrites    int
+	BatchSize            int
+	BatchConcurrency     int
+	Retry                write.RetryConfig
+	DeadLetterFile       string
+
+	AppendSchemaWriter       write.AppendSchemaWriter
+	RelationshipWriter       write.RelationshipWriter
+	ImportRelationshipWriter write.RelationshipWriter
 }
 
 // NewOptions returns initialized Options
 func NewOptions(ioStreams streams.IO) *Options {
 	return &Options{
-		IO: ioStreams,
+		IO:                ioStreams,
+		ImportConcurrency: 1,
+		ImportKeyRanges:   1,
+		MaxInflightWrites: 4,
+		BatchSize:         1000,
+		BatchConcurrency:  1,
+		Retry:             write.DefaultRetryConfig(),
 	}
 }
 
+// RegisterRetryFlags registers the flags that control how failed requests to
+// SpiceDB are retried
+func RegisterRetryFlags(cmd *cobra.Command, o *Options) {
+	cmd.Flags().IntVar(&o.Retry.MaxAttempts, "write-max-attempts", o.Retry.MaxAttempts, "number of times a write to SpiceDB is tried when SpiceDB is unavailable or overloaded, 0 retries until --write-max-elapsed-time")
+	cmd.Flags().DurationVar(&o.Retry.AttemptTimeout, "write-attempt-timeout", o.Retry.AttemptTimeout, "how long a single attempt to write to SpiceDB can take, 0 for no limit")
+	cmd.Flags().DurationVar(&o.Retry.MaxElapsedTime, "write-max-elapsed-time", o.Retry.MaxElapsedTime, "how long a write to SpiceDB is retried for, 0 retries until --write-max-attempts")
+	cmd.Flags().StringVar(&o.DeadLetterFile, "dead-letter-file", "", "path to a file that writes rejected by SpiceDB as invalid are appended to; they are only logged if empty")
+}
+
+// RegisterBatchFlags registers the flags that control how relationships are
+// batched into requests to SpiceDB
+func RegisterBatchFlags(cmd *cobra.Command, o *Options) {
+	cmd.Flags().IntVar(&o.BatchSize, "batch-size", o.BatchSize, "maximum number of relationship updates sent to SpiceDB in one request while importing, 0 disables batching")
+	cmd.Flags().IntVar(&o.BatchConcurrency, "batch-concurrency", o.BatchConcurrency, "number of batches of a single write that are sent to SpiceDB at the same time while importing")
+}
+
+// RegisterConcurrencyFlags registers the flags that control how many tables
+// are imported in parallel
+func RegisterConcurrencyFlags(cmd *cobra.Command, o *Options) {
+	cmd.Flags().IntVar(&o.ImportConcurrency, "import-concurrency", o.ImportConcurrency, "number of tables and mappings (or key ranges) to import in parallel")
+	cmd.Flags().IntVar(&o.ImportKeyRanges, "import-key-ranges", o.ImportKeyRanges, "split tables with a primary key into this many key ranges that are imported in parallel")
+	cmd.Flags().IntVar(&o.MaxInflightWrites, "import-max-inflight-writes", o.MaxInflightWrites, "maximum number of write requests to SpiceDB in flight at a time while importing")
+}
+
+// ImporterOptions returns the options for a PostgresImporter that
+// implement the concurrency flags
+func (o *Options) ImporterOptions() []importer.Option {
+	return []importer.Option{importer.WithConcurrency(o.ImportConcurrency, o.ImportKeyRanges)}
+}
+
+// setRelationshipWriters sets the writers for the import and for the
+// replication log. Only the importer's writes are batched, and limited to
+// MaxInflightWrites requests at a time; each write of RelationshipWriter is
+// sent as one request, so that a postgres transaction that fits in one is
+// applied atomically.
+func (o *Options) setRelationshipWriters(writer write.RelationshipWriter) {
+	o.RelationshipWriter = writer
+	o.ImportRelationshipWriter = write.NewBatchingRelationshipWriter(write.NewLimitingRelationshipWriter(writer, o.MaxInflightWrites), o.BatchSize, o.BatchConcurrency)
+}
+
 // Complete fills out default values before running
 func (o *Options) Complete(ctx context.Context, args []string) error {
 	if len(args) == 1 {
@@ -81,15 +145,40 @@ func (o *Options) Complete(ctx context.Context, args []string) error {
 		return err
 	}
 
+	if o.Resume && o.ImportCheckpointFile == "" {
+		return fmt.Errorf("must provide an import checkpoint file to resume from")
+	}
+
+	if o.BatchSize < 0 || o.BatchConcurrency < 1 {
+		return fmt.Errorf("batch size must not be negative and batch concurrency must be at least 1")
+	}
+
+	if o.Retry.MaxAttempts < 0 || o.Retry.AttemptTimeout < 0 || o.Retry.MaxElapsedTime < 0 {
+		return fmt.Errorf("write retry limits must not be negative")
+	}
+
+	if o.ImportConcurrency < 1 || o.ImportKeyRanges < 1 || o.MaxInflightWrites < 1 {
+		return fmt.Errorf("import concurrency, key ranges and max inflight writes must be at least 1")
+	}
+	// each worker holds a connection for its transaction, and the first
+	// transaction holds the snapshot the workers read from
+	if o.ImportConcurrency > 1 && o.PoolConfig.MaxConns < int32(o.ImportConcurrency+1) {
+		o.PoolConfig.MaxConns = int32(o.ImportConcurrency + 1)
+	}
+
 	if o.DryRun {
 		log.Warn().Msg("Running in dry-run mode. No schema or relationships will be written to SpiceDB.")
-		o.RelationshipWriter = write.NewDryRunRelationshipWriter()
+		o.setRelationshipWriters(write.NewDryRunRelationshipWriter())
 		o.AppendSchemaWriter = write.NewDryRunSchemaAppendWriter(o.Client)
 		return nil
 	}
 
 	o.AppendSchemaWriter = write.NewSchemaAppendWriter(o.Client, !o.AppendSchema)
-	o.RelationshipWriter = write.NewRelationshipWriter(o.Client)
+	var deadLetter write.DeadLetter = write.LoggingDeadLetter{}
+	if o.DeadLetterFile != "" {
+		deadLetter = write.NewFileDeadLetter(o.DeadLetterFile)
+	}
+	o.setRelationshipWriters(write.NewRetryingRelationshipWriter(write.NewRelationshipWriter(o.Client), o.Retry, deadLetter))
 	return nil
 }
 
@@ -107,7 +196,26 @@ func (o *Options) Run(ctx context.Context) error {
 		return err
 	}
 
-	if err := importer.NewPostgresImporter(conn, o.RelationshipWriter, o.Config.Tables).Import(ctx); err != nil {
+	replogConn, err := pgxpool.ConnectConfig(ctx, o.ReplogConfig)
+	if err != nil {
+		return err
+	}
+	defer replogConn.Close()
+	tableNames := make([]string, 0, len(o.Config.Tables))
+	for _, t := range o.Config.Tables {
+		tableNames = append(tableNames, t.Name)
+	}
+	schema, err := pgschema.SyncSchema(ctx, replogConn, tableNames...)
+	if err != nil {
+		return err
+	}
+
+	opts := append(o.ImporterOptions(), importer.WithPrimaryKeys(schema.PrimaryKeys()))
+	// a dry run writes nothing, so it must not be recorded as progress
+	if o.ImportCheckpointFile != "" && !o.DryRun {
+		opts = append(opts, importer.WithProgress(checkpoint.NewFileImportStore(o.ImportCheckpointFile), o.Resume))
+	}
+	if err := importer.NewPostgresImporter(conn, o.ImportRelationshipWriter, o.Config.Tables, opts...).Import(ctx); err != nil {
 		return err
 	}
 
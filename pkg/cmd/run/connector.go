@@ -2,8 +2,12 @@ package run
 
 import (
 	"context"
+	"fmt"
+	"time"
 
-	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pglogrepl"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/jzelinskie/cobrautil"
 	"github.com/rs/zerolog/log"
@@ -12,10 +16,26 @@ import (
 	"github.com/authzed/connector-postgresql/pkg/cache"
 	importercmd "github.com/authzed/connector-postgresql/pkg/cmd/importer"
 	"github.com/authzed/connector-postgresql/pkg/follow"
+	"github.com/authzed/connector-postgresql/pkg/health"
 	"github.com/authzed/connector-postgresql/pkg/importer"
+	"github.com/authzed/connector-postgresql/pkg/metrics"
+	"github.com/authzed/connector-postgresql/pkg/options"
 	"github.com/authzed/connector-postgresql/pkg/pgschema"
 	"github.com/authzed/connector-postgresql/pkg/streams"
 	"github.com/authzed/connector-postgresql/pkg/util"
+	"github.com/authzed/connector-postgresql/pkg/write"
+)
+
+const (
+	// maxRequeueInterval limits how long a transaction that failed to apply
+	// waits before it is tried again
+	maxRequeueInterval = 30 * time.Second
+	// checkpointInterval limits how often the applied position is saved to
+	// the checkpoint store
+	checkpointInterval = time.Second
+	// shutdownTimeout limits how long the final checkpoint, standby status
+	// and dropping the replication slot can take once the cache has drained
+	shutdownTimeout = 10 * time.Second
 )
 
 // NewRunCmd configures a new cobra command that both imports (backfills) data
@@ -40,7 +60,21 @@ func NewRunCmd(ctx context.Context, streams streams.IO) *cobra.Command {
 	cmd.Flags().BoolVar(&o.DryRun, "dry-run", true, "print relationships that would be written to SpiceDB")
 	cmd.Flags().StringVar(&o.MappingFile, "config", "", "path to a file containing the config that maps between pg tables and spicedb relationships")
 	cmd.Flags().BoolVar(&o.AppendSchema, "append-schema", true, "append the config's (zed) schema to the schema in spicedb")
-	cmd.Flags().StringVar(&o.MetricsAddr, "metrics-addr", ":9090", "address that will serve prometheus data (default: :9090")
+	cmd.Flags().StringVar(&o.MetricsAddr, "metrics-addr", o.MetricsAddr, "address that will serve prometheus metrics on /metrics")
+	cmd.Flags().StringVar(&o.SlotName, "slot-name", o.SlotName, "name of the replication slot (used as a prefix of at most 52 characters for temporary slots)")
+	cmd.Flags().BoolVar(&o.TemporarySlot, "temporary-slot", o.TemporarySlot, "use a temporary replication slot that is dropped on exit; permanent slots allow resuming from a checkpoint after a restart")
+	cmd.Flags().IntVar(&o.MaxTransactionSize, "max-transaction-size", o.MaxTransactionSize, "maximum number of relationship updates written to SpiceDB in one request; larger postgres transactions are split")
+	cmd.Flags().StringVar(&o.TruncatePolicy, "truncate-policy", o.TruncatePolicy, "what to do when a mapped table is truncated: apply (delete its relationships), log, or refuse (stop with an error)")
+	cmd.Flags().DurationVar(&o.RetryWindow, "replication-retry-window", o.RetryWindow, "how long to keep trying to resume replication after the connection to postgres is lost before exiting, 0 retries forever (permanent slots only)")
+	cmd.Flags().DurationVar(&o.ShutdownGracePeriod, "shutdown-grace-period", o.ShutdownGracePeriod, "how long to keep writing changes that were already received to SpiceDB after being asked to stop")
+	cmd.Flags().StringVar(&o.Publication, "publication", o.Publication, "name of the publication to subscribe to")
+	cmd.Flags().StringVar(&o.PublicationMode, "publication-mode", o.PublicationMode, "create: create the publication for the mapped tables, or add missing tables to it; existing: use an existing publication as is")
+	importercmd.RegisterConcurrencyFlags(cmd, &o.Options)
+	importercmd.RegisterBatchFlags(cmd, &o.Options)
+	importercmd.RegisterRetryFlags(cmd, &o.Options)
+	cmd.Flags().StringVar(&o.CheckpointFile, "checkpoint-file", o.CheckpointFile, "path to a file that stores the last position in the replication log that was written to SpiceDB (permanent slots only)")
+	cmd.Flags().DurationVar(&o.KeepaliveThreshold, "liveness-keepalive-threshold", o.KeepaliveThreshold, "/healthz fails if nothing, not even a keepalive, has been received from postgres for this long while replicating, or for this long plus the replication retry window while reconnecting")
+	cmd.Flags().DurationVar(&o.DrainThreshold, "liveness-drain-threshold", o.DrainThreshold, "/healthz fails if a received change has not been written to SpiceDB for this long")
 	cobrautil.RegisterZeroLogFlags(cmd.Flags(), "log")
 
 	return cmd
@@ -49,15 +83,32 @@ func NewRunCmd(ctx context.Context, streams streams.IO) *cobra.Command {
 // Options holds options for the postgres connector
 type Options struct {
 	importercmd.Options
+	options.ReplicationOptions
+
+	MetricsAddr        string
+	KeepaliveThreshold time.Duration
+	DrainThreshold     time.Duration
 
-	MetricsAddr string
+	// RelationshipReader resolves deletes by filter in the replication log
+	RelationshipReader write.RelationshipReader
 }
 
 // NewOptions returns initialized Options
 func NewOptions(ioStreams streams.IO) *Options {
 	return &Options{
-		Options: importercmd.Options{
-			IO: ioStreams,
+		Options:            *importercmd.NewOptions(ioStreams),
+		MetricsAddr:        ":9090",
+		KeepaliveThreshold: time.Minute,
+		DrainThreshold:     5 * time.Minute,
+		ReplicationOptions: options.ReplicationOptions{
+			SlotName:            "spicedb_sync_slot",
+			CheckpointFile:      "connector-postgresql.checkpoint",
+			MaxTransactionSize:  1000,
+			TruncatePolicy:      string(follow.TruncatePolicyApply),
+			RetryWindow:         5 * time.Minute,
+			ShutdownGracePeriod: 30 * time.Second,
+			Publication:         "spicedb_sync",
+			PublicationMode:     string(follow.PublicationModeCreate),
 		},
 	}
 }
@@ -68,12 +119,46 @@ func (o *Options) Complete(ctx context.Context, args []string) error {
 		return err
 	}
 
-	// TODO: metrics server
+	if err := o.ReplicationOptions.Complete(); err != nil {
+		return err
+	}
+
+	if o.MetricsAddr == "" {
+		return fmt.Errorf("must provide a metrics address")
+	}
+	if o.KeepaliveThreshold <= 0 || o.DrainThreshold <= 0 {
+		return fmt.Errorf("liveness thresholds must be positive")
+	}
+
+	if o.DryRun {
+		o.RelationshipReader = write.DryRunRelationshipReader{}
+	} else {
+		o.RelationshipReader = write.NewRelationshipReader(o.Client)
+	}
 	return nil
 }
 
-// Run does a backfill and then watches for changes
+// Run does a backfill and then watches for changes. If a permanent
+// replication slot and a checkpoint from a previous run exist, the backfill is
+// skipped and replication resumes from the checkpoint.
+// Run returns an error if replication stops and can't be resumed.
+// When ctx is cancelled, Run stops reading the replication log and writes the
+// changes that were already received to SpiceDB for up to the shutdown grace
+// period. The replication slot is then dropped (or retained, if permanent)
+// with a new context, since ctx is already done.
 func (o *Options) Run(ctx context.Context) error {
+	checker := health.NewChecker()
+	server := metrics.NewServer(o.MetricsAddr)
+	server.Handle("/healthz", checker.LivenessHandler())
+	server.Handle("/readyz", checker.ReadinessHandler())
+	metricsCtx, stopMetrics := context.WithCancel(context.Background())
+	defer stopMetrics()
+	go func() {
+		if err := server.Run(metricsCtx); err != nil {
+			log.Error().Err(err).Msg("metrics server stopped")
+		}
+	}()
+
 	log.Info().EmbedObject(util.LoggedConnConfig{ConnConfig: o.PoolConfig.ConnConfig}).Msg("connecting to postgres")
 
 	conn, err := pgxpool.ConnectConfig(ctx, o.PoolConfig)
@@ -82,20 +167,23 @@ func (o *Options) Run(ctx context.Context) error {
 	}
 	defer conn.Close()
 
-	pgImport := importer.NewPostgresImporter(conn, o.RelationshipWriter, o.Config.Tables)
-	if err := pgImport.Import(ctx); err != nil {
-		return err
-	}
-
 	replogConn, err := pgxpool.ConnectConfig(ctx, o.ReplogConfig)
 	if err != nil {
 		return err
 	}
 	defer replogConn.Close()
 
-	repCache := cache.NewCache(ctx)
+	// the cache and writes to spicedb outlive ctx, so that received changes
+	// can be drained after reading the replication log stops
+	drainCtx, cancelDrain := context.WithCancel(context.Background())
+	defer cancelDrain()
+	repCache := cache.NewCache(drainCtx)
 	log.Info().Msg("syncing schema")
-	schema, err := pgschema.SyncSchema(ctx, replogConn)
+	tableNames := make([]string, 0, len(o.Config.Tables))
+	for _, t := range o.Config.Tables {
+		tableNames = append(tableNames, t.Name)
+	}
+	schema, err := pgschema.SyncSchema(ctx, replogConn, tableNames...)
 	if err != nil {
 		return err
 	}
@@ -104,37 +192,241 @@ func (o *Options) Run(ctx context.Context) error {
 		log.Debug().Stringer("XLogPos", schema.XLogPos).Str("table", t.Name).Msgf("%#v", *t)
 	}
 
-	repconn, err := replogConn.Acquire(ctx)
+	connect := func(ctx context.Context) (*pgconn.PgConn, error) {
+		return pgconn.ConnectConfig(ctx, o.ReplogConfig.ConnConfig.Config.Copy())
+	}
+	repconn, err := connect(ctx)
 	if err != nil {
 		return err
 	}
-	defer repconn.Release()
 
-	follower := follow.NewWalFollower(repconn.Conn().PgConn(), schema.InternalMapping(o.Config.Tables), repCache)
+	follower := follow.NewWalFollower(repconn, o.Config.Tables, repCache, follow.Options{
+		SlotName:        o.SlotName,
+		TemporarySlot:   o.TemporarySlot,
+		TruncatePolicy:  follow.TruncatePolicy(o.TruncatePolicy),
+		Publication:     o.Publication,
+		PublicationMode: follow.PublicationMode(o.PublicationMode),
+	})
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = follower.Close(closeCtx)
+	}()
+
+	o.addHealthChecks(checker, follower, repCache)
 
+	importOpts := append(o.ImporterOptions(), importer.WithPrimaryKeys(schema.PrimaryKeys()))
+	startpos, err := o.prepareReplication(ctx, conn, follower, importOpts...)
+	if err != nil {
+		return err
+	}
+	// spicedb has caught up with the replication slot
+	checker.AddReadinessCheck("import", func() error { return nil })
+
+	supervisor := follow.NewSupervisor(follower, connect, o.RetryWindow)
+	errCh := make(chan error, 1)
 	go func() {
-		// TODO: separate contexts - killing the existing ctx will kill the connection
-		// before the slots can be dropped
-		if err := follower.Follow(ctx, schema.XLogPos); err != nil {
-			log.Info().Err(err).Msg("stopped")
+		err := supervisor.Run(ctx, startpos)
+		if err != nil {
+			log.Error().Err(err).Msg("replication stopped")
+		}
+		errCh <- err
+
+		// the replication log is no longer read, write what has already
+		// been received
+		log.Info().Int("transactions", repCache.Len()).Dur("gracePeriod", o.ShutdownGracePeriod).Msg("draining cache")
+		repCache.Close()
+		timer := time.NewTimer(o.ShutdownGracePeriod)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			log.Warn().Int("transactions", repCache.Len()).Msg("shutdown grace period expired, discarding changes that weren't written")
+			cancelDrain()
+		case <-drainCtx.Done():
 		}
 	}()
 
-	for r := repCache.Next(); r != nil; r = repCache.Next() {
-		log.Trace().Stringer("operation", r.OpType).Msg(util.RelString(r.Rel))
-		err := o.RelationshipWriter.Write(ctx, []*v1.RelationshipUpdate{
-			{
-				Operation:    r.OpType.RelationshipUpdateOpType(),
-				Relationship: r.Rel,
-			},
-		})
-		if err == nil {
+	var checkpointed pglogrepl.LSN
+	var lastCheckpoint time.Time
+	// transactions are applied in order, so a failed one is retried until it
+	// succeeds, backing off so as not to overwhelm SpiceDB
+	requeueBackoff := backoff.NewExponentialBackOff()
+	requeueBackoff.MaxInterval = maxRequeueInterval
+	requeueBackoff.MaxElapsedTime = 0
+	for txn := repCache.Next(); txn != nil; txn = repCache.Next() {
+		if err := o.applyTransaction(drainCtx, txn); err != nil {
+			wait := requeueBackoff.NextBackOff()
+			log.Warn().Err(err).Stringer("commit", txn.CommitLSN).Dur("wait", wait).Msg("requeueing transaction")
+			repCache.Requeue(txn)
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-drainCtx.Done():
+				timer.Stop()
+			}
 			continue
 		}
-		log.Warn().Err(err).Str("rel", util.RelString(r.Rel)).Stringer("op", r.OpType).Msg("requeueing")
+		requeueBackoff.Reset()
+		repCache.Done(txn)
 
-		repCache.Requeue(r.OpType, r.Rel)
+		if time.Since(lastCheckpoint) < checkpointInterval {
+			continue
+		}
+		applied := repCache.Applied()
+		if applied <= checkpointed {
+			continue
+		}
+		if err := o.CheckpointStore.Save(drainCtx, applied); err != nil {
+			log.Warn().Err(err).Stringer("lsn", applied).Msg("failed to save checkpoint")
+			continue
+		}
+		log.Debug().Stringer("applied", applied).Stringer("committed", repCache.Committed()).Msg("saved checkpoint")
+		checkpointed = applied
+		lastCheckpoint = time.Now()
 	}
+	cancelDrain()
+	err = <-errCh
 
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if applied := repCache.Applied(); applied > checkpointed {
+		if err := o.CheckpointStore.Save(shutdownCtx, applied); err != nil {
+			log.Warn().Err(err).Stringer("lsn", applied).Msg("failed to save checkpoint")
+		}
+	}
+	if err := follower.Shutdown(shutdownCtx); err != nil {
+		log.Warn().Err(err).Str("slot", follower.SlotName()).Msg("failed to shut down replication")
+	}
+	return err
+}
+
+// addHealthChecks reports the follower and cache as unhealthy when
+// replication or writes to SpiceDB appear to be stuck, and as not ready until
+// replication is streaming
+func (o *Options) addHealthChecks(checker *health.Checker, follower *follow.WalFollower, repCache *cache.Cache) {
+	checker.AddReadinessCheck("import", func() error {
+		return fmt.Errorf("import has not finished")
+	})
+	checker.AddReadinessCheck("replication", func() error {
+		if !follower.Streaming() {
+			return fmt.Errorf("not streaming the replication log")
+		}
+		return nil
+	})
+	checker.AddLivenessCheck("replication", func() error {
+		last := follower.LastMessage()
+		threshold, ok := o.keepaliveThreshold(follower.Streaming())
+		if ok && !last.IsZero() && time.Since(last) > threshold {
+			return fmt.Errorf("no message from postgres since %s", last.Format(time.RFC3339))
+		}
+		return nil
+	})
+	checker.AddLivenessCheck("cache", func() error {
+		oldest := repCache.OldestPending()
+		if !oldest.IsZero() && time.Since(oldest) > o.DrainThreshold {
+			return fmt.Errorf("changes received at %s have not been written to SpiceDB", oldest.Format(time.RFC3339))
+		}
+		return nil
+	})
+}
+
+// keepaliveThreshold is how long the follower can go without a message from
+// postgres before it is considered dead. While it isn't streaming the
+// supervisor is reconnecting, and gives up by itself if it can't within the
+// retry window. It returns false if there is no threshold, because the
+// supervisor is reconnecting and retries forever.
+func (o *Options) keepaliveThreshold(streaming bool) (time.Duration, bool) {
+	if streaming {
+		return o.KeepaliveThreshold, true
+	}
+	if o.RetryWindow == 0 {
+		return 0, false
+	}
+	return o.KeepaliveThreshold + o.RetryWindow, true
+}
+
+// applyTransaction writes the updates from a postgres transaction to SpiceDB
+// in a single request. Deletes by filter are first resolved into the
+// relationships they match, so they are part of the same request.
+// Truncates are the exception: they are sent as DeleteRelationships requests
+// before the rest of the transaction, since they can match any number of
+// relationships. Transactions with truncates, or with more than
+// MaxTransactionSize updates, need several requests, which are not atomic
+// with each other.
+func (o *Options) applyTransaction(ctx context.Context, txn *cache.Transaction) error {
+	for _, filter := range txn.Truncates() {
+		if err := o.RelationshipWriter.Delete(ctx, filter); err != nil {
+			return err
+		}
+	}
+	updates, err := txn.Updates(ctx, o.RelationshipReader.Read)
+	if err != nil {
+		return err
+	}
+	size := o.MaxTransactionSize
+	if size <= 0 {
+		size = len(updates)
+	}
+	if len(updates) > size {
+		log.Debug().Stringer("commit", txn.CommitLSN).Int("updates", len(updates)).Int("requests", (len(updates)+size-1)/size).Msg("transaction can't be applied atomically, splitting")
+	}
+	for start := 0; start < len(updates); start += size {
+		end := start + size
+		if end > len(updates) {
+			end = len(updates)
+		}
+		if err := o.RelationshipWriter.Write(ctx, updates[start:end]); err != nil {
+			return err
+		}
+	}
+	log.Debug().Stringer("commit", txn.CommitLSN).Int("updates", len(updates)).Msg("applied transaction")
 	return nil
 }
+
+// prepareReplication makes sure the replication slot exists and that SpiceDB
+// has caught up to it, and returns the position to start replication from.
+// New slots export a snapshot of the database at the slot's consistent point,
+// and the import reads from that snapshot. This way the import and the
+// replication log meet exactly: every change is either in the import or in
+// the replication log, never both and never neither.
+func (o *Options) prepareReplication(ctx context.Context, conn *pgxpool.Pool, follower *follow.WalFollower, importOpts ...importer.Option) (pglogrepl.LSN, error) {
+	if err := follower.PreparePublication(ctx); err != nil {
+		return 0, err
+	}
+
+	if !o.TemporarySlot {
+		exists, err := follower.SlotExists(ctx)
+		if err != nil {
+			return 0, err
+		}
+		lsn, found, err := o.CheckpointStore.Load(ctx)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case exists && found:
+			log.Info().Str("slot", follower.SlotName()).Stringer("lsn", lsn).Msg("resuming replication from checkpoint, skipping import")
+			return lsn, nil
+		case exists:
+			// without a checkpoint there's no telling what made it to
+			// spicedb, so the slot is recreated to get a new snapshot to
+			// import from
+			log.Info().Str("slot", follower.SlotName()).Msg("no checkpoint found for existing replication slot, re-importing")
+			if err := follower.DropSlot(ctx); err != nil {
+				return 0, err
+			}
+		case found:
+			log.Warn().Str("slot", follower.SlotName()).Stringer("lsn", lsn).Msg("replication slot for checkpoint no longer exists, re-importing")
+		}
+	}
+
+	startpos, snapshot, err := follower.CreateSlot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	importOpts = append(importOpts, importer.WithSnapshot(snapshot))
+	if err := importer.NewPostgresImporter(conn, o.ImportRelationshipWriter, o.Config.Tables, importOpts...).Import(ctx); err != nil {
+		return 0, err
+	}
+	return startpos, nil
+}
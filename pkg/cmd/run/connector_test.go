@@ -0,0 +1,128 @@
+package run
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/authzed/connector-postgresql/pkg/cache"
+	"github.com/authzed/connector-postgresql/pkg/streams"
+	"github.com/authzed/connector-postgresql/pkg/util"
+)
+
+// recordingWriter records the requests it gets, in order
+type recordingWriter struct {
+	requests []string
+	writes   [][]*v1.RelationshipUpdate
+}
+
+func (w *recordingWriter) Write(ctx context.Context, updates []*v1.RelationshipUpdate) error {
+	w.requests = append(w.requests, "write")
+	w.writes = append(w.writes, updates)
+	return nil
+}
+
+func (w *recordingWriter) Delete(ctx context.Context, filter *v1.RelationshipFilter) error {
+	w.requests = append(w.requests, "delete "+util.FilterString(filter))
+	return nil
+}
+
+// staticReader returns the same relationships for every filter
+type staticReader []*v1.Relationship
+
+func (r staticReader) Read(ctx context.Context, filter *v1.RelationshipFilter) ([]*v1.Relationship, error) {
+	return r, nil
+}
+
+func contact(id string) *v1.Relationship {
+	return &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: "contact", ObjectId: id},
+		Relation: "customer",
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "customer", ObjectId: "1"}},
+	}
+}
+
+func TestApplyTransaction(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		build    func(*cache.Transaction)
+		requests []string
+		sizes    []int
+	}{
+		{
+			name: "one request",
+			size: 10,
+			build: func(txn *cache.Transaction) {
+				txn.Touch(contact("1"))
+				txn.Touch(contact("2"))
+				// resolved into a delete of contact:9 in the same request
+				txn.DeleteMatching(&v1.RelationshipFilter{ResourceType: "contact", OptionalResourceId: "9"})
+			},
+			requests: []string{"write"},
+			sizes:    []int{3},
+		},
+		{
+			name: "split by max transaction size",
+			size: 2,
+			build: func(txn *cache.Transaction) {
+				for _, id := range []string{"1", "2", "3", "4", "5"} {
+					txn.Touch(contact(id))
+				}
+			},
+			requests: []string{"write", "write", "write"},
+			sizes:    []int{2, 2, 1},
+		},
+		{
+			name: "truncates first",
+			size: 10,
+			build: func(txn *cache.Transaction) {
+				txn.Truncate(&v1.RelationshipFilter{ResourceType: "contact"})
+				txn.Touch(contact("1"))
+			},
+			requests: []string{"delete contact:*#*@*:*", "write"},
+			sizes:    []int{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &recordingWriter{}
+			o := NewOptions(streams.IO{})
+			o.RelationshipWriter = writer
+			o.RelationshipReader = staticReader{contact("9")}
+			o.MaxTransactionSize = tt.size
+
+			txn := cache.NewTransaction(1)
+			tt.build(txn)
+			require.NoError(t, o.applyTransaction(context.Background(), txn))
+			require.Equal(t, tt.requests, writer.requests)
+			sizes := make([]int, 0, len(writer.writes))
+			for _, w := range writer.writes {
+				sizes = append(sizes, len(w))
+			}
+			require.Equal(t, tt.sizes, sizes)
+		})
+	}
+}
+
+func TestKeepaliveThreshold(t *testing.T) {
+	o := NewOptions(streams.IO{})
+	threshold, ok := o.keepaliveThreshold(true)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, threshold)
+	// the supervisor has the whole retry window to reconnect
+	threshold, ok = o.keepaliveThreshold(false)
+	require.True(t, ok)
+	require.Equal(t, 6*time.Minute, threshold)
+
+	// without a retry window the supervisor reconnects forever
+	o.RetryWindow = 0
+	_, ok = o.keepaliveThreshold(false)
+	require.False(t, ok)
+	threshold, ok = o.keepaliveThreshold(true)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, threshold)
+}
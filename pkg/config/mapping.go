@@ -1,5 +1,12 @@
 package config
 
+import (
+	"fmt"
+	"sort"
+
+	"github.com/authzed/connector-postgresql/pkg/filter"
+)
+
 // Config holds a zed schema and a tablemapping that generates that schema
 type Config struct {
 	Tables []TableMapping `json:"tables"`
@@ -20,21 +27,309 @@ type RowMapping struct {
 	Relation       string   `json:"relation"`
 	ResourceIDCols []string `json:"resource_id_cols"`
 	SubjectIDCols  []string `json:"subject_id_cols"`
+	// SubjectRelation makes the subject a subject set, e.g. group:eng#member
+	SubjectRelation string `json:"subject_relation,omitempty"`
+	// SubjectRelationCol takes the subject relation from a column instead.
+	// Rows where it is null or empty have a plain subject.
+	SubjectRelationCol string `json:"subject_relation_col,omitempty"`
+	// WildcardWhen makes the subject a wildcard, e.g. user:*, instead of
+	// taking it from SubjectIDCols. Only rows for which the predicate holds
+	// generate a relationship.
+	WildcardWhen *ColumnPredicate `json:"wildcard_when,omitempty"`
+	// Filter limits the rows that generate a relationship to those that
+	// match it, e.g. `deleted_at IS NULL`. See the filter package for the
+	// syntax.
+	Filter string `json:"filter,omitempty"`
+	// RelationFromCol takes the relation from a column instead of Relation.
+	// Rows where it is null don't generate a relationship.
+	RelationFromCol string `json:"relation_from_col,omitempty"`
+	// RelationMap maps the values of RelationFromCol to relations. If it is
+	// empty, the values are used as relations.
+	RelationMap map[string]string `json:"relation_map,omitempty"`
+	// UnknownRelation is what to do with values of RelationFromCol that are
+	// not in RelationMap: skip (the default), error or passthrough.
+	UnknownRelation UnknownRelationPolicy `json:"unknown_relation,omitempty"`
+	// ResourceTypeFromCol takes the resource type from a column instead of
+	// ResourceType, for polymorphic tables. ResourceTypeMap maps its values
+	// to definitions; rows with other values don't generate a relationship.
+	ResourceTypeFromCol string            `json:"resource_type_from_col,omitempty"`
+	ResourceTypeMap     map[string]string `json:"resource_type_map,omitempty"`
+	// SubjectTypeFromCol and SubjectTypeMap do the same for the subject type
+	SubjectTypeFromCol string            `json:"subject_type_from_col,omitempty"`
+	SubjectTypeMap     map[string]string `json:"subject_type_map,omitempty"`
+}
+
+// UnknownRelationPolicy determines what happens to rows whose relation
+// column has a value that is not in the RowMapping's RelationMap
+type UnknownRelationPolicy string
+
+const (
+	// UnknownRelationSkip doesn't generate a relationship for the row
+	UnknownRelationSkip UnknownRelationPolicy = "skip"
+	// UnknownRelationError stops the import or replication with an error
+	UnknownRelationError UnknownRelationPolicy = "error"
+	// UnknownRelationPassthrough uses the value as the relation
+	UnknownRelationPassthrough UnknownRelationPolicy = "passthrough"
+)
+
+// ResolveRelation returns the relation for a value of a relation column. It
+// returns false if no relationship should be generated for the value, and an
+// error if the policy is to fail on unknown values.
+func ResolveRelation(value string, relationMap map[string]string, policy UnknownRelationPolicy) (string, bool, error) {
+	if len(relationMap) == 0 {
+		return value, value != "", nil
+	}
+	if relation, ok := relationMap[value]; ok {
+		return relation, true, nil
+	}
+	switch policy {
+	case UnknownRelationPassthrough:
+		return value, value != "", nil
+	case UnknownRelationError:
+		return "", false, fmt.Errorf("no relation for value %q", value)
+	}
+	return "", false, nil
+}
+
+// ColumnPredicate holds for rows where the column has one of the values.
+// Values are compared as text, except for boolean columns, where any of
+// postgres' spellings of true and false can be used.
+type ColumnPredicate struct {
+	Col    string   `json:"col"`
+	Values []string `json:"values"`
+}
+
+// Validate checks that the ColumnPredicate is complete
+func (p ColumnPredicate) Validate() error {
+	if p.Col == "" || len(p.Values) == 0 {
+		return fmt.Errorf("col and values are required")
+	}
+	return nil
+}
+
+// Validate checks that the RowMapping is consistent
+func (rm RowMapping) Validate() error {
+	if (rm.ResourceType == "") == (rm.ResourceTypeFromCol == "") {
+		return fmt.Errorf("one of resource_type and resource_type_from_col is required")
+	}
+	if (rm.SubjectType == "") == (rm.SubjectTypeFromCol == "") {
+		return fmt.Errorf("one of subject_type and subject_type_from_col is required")
+	}
+	if rm.ResourceTypeFromCol != "" && len(rm.ResourceTypeMap) == 0 {
+		return fmt.Errorf("resource_type_from_col requires a resource_type_map")
+	}
+	if rm.SubjectTypeFromCol != "" && len(rm.SubjectTypeMap) == 0 {
+		return fmt.Errorf("subject_type_from_col requires a subject_type_map")
+	}
+	if (rm.Relation == "") == (rm.RelationFromCol == "") {
+		return fmt.Errorf("one of relation and relation_from_col is required")
+	}
+	switch rm.UnknownRelation {
+	case "", UnknownRelationSkip, UnknownRelationError, UnknownRelationPassthrough:
+	default:
+		return fmt.Errorf("unknown_relation must be one of %s, %s or %s", UnknownRelationSkip, UnknownRelationError, UnknownRelationPassthrough)
+	}
+	if rm.SubjectRelation != "" && rm.SubjectRelationCol != "" {
+		return fmt.Errorf("only one of subject_relation and subject_relation_col can be set")
+	}
+	if _, err := rm.ParseFilter(); err != nil {
+		return fmt.Errorf("filter: %w", err)
+	}
+	if rm.WildcardWhen != nil {
+		if err := rm.WildcardWhen.Validate(); err != nil {
+			return fmt.Errorf("wildcard_when: %w", err)
+		}
+		if len(rm.SubjectIDCols) > 0 || rm.SubjectRelation != "" || rm.SubjectRelationCol != "" {
+			return fmt.Errorf("wildcard subjects can't have subject_id_cols or a subject relation")
+		}
+	}
+	return nil
+}
+
+// ParseFilter parses the RowMapping's filter, which is nil if there is none
+func (rm RowMapping) ParseFilter() (filter.Expr, error) {
+	if rm.Filter == "" {
+		return nil, nil
+	}
+	return filter.Parse(rm.Filter)
+}
+
+// RelationLabel is the RowMapping's relation, or the relation column in
+// braces if the relation comes from a column, for errors and logs
+func (rm RowMapping) RelationLabel() string {
+	if rm.RelationFromCol != "" {
+		return "{" + rm.RelationFromCol + "}"
+	}
+	return rm.Relation
+}
+
+// ResourceTypeLabel is the RowMapping's resource type, or the resource type
+// column in braces if the type comes from a column, for errors and logs
+func (rm RowMapping) ResourceTypeLabel() string {
+	if rm.ResourceTypeFromCol != "" {
+		return "{" + rm.ResourceTypeFromCol + "}"
+	}
+	return rm.ResourceType
+}
+
+// SubjectTypeLabel is the subject type counterpart of ResourceTypeLabel
+func (rm RowMapping) SubjectTypeLabel() string {
+	if rm.SubjectTypeFromCol != "" {
+		return "{" + rm.SubjectTypeFromCol + "}"
+	}
+	return rm.SubjectType
+}
+
+// ResourceTypes returns the resource types that the RowMapping can generate,
+// sorted if they come from a column
+func (rm RowMapping) ResourceTypes() []string {
+	if rm.ResourceTypeFromCol == "" {
+		return []string{rm.ResourceType}
+	}
+	return mapValues(rm.ResourceTypeMap)
+}
+
+// SubjectTypes returns the subject types that the RowMapping can generate,
+// sorted if they come from a column
+func (rm RowMapping) SubjectTypes() []string {
+	if rm.SubjectTypeFromCol == "" {
+		return []string{rm.SubjectType}
+	}
+	return mapValues(rm.SubjectTypeMap)
+}
+
+// Relations returns the relations that the RowMapping can generate, sorted if
+// they come from a column. It is nil if values of the relation column are
+// used as relations, since then any relation can be generated.
+func (rm RowMapping) Relations() []string {
+	return relations(rm.Relation, rm.RelationFromCol != "", rm.RelationMap, rm.UnknownRelation)
+}
+
+func relations(static string, fromCol bool, relationMap map[string]string, policy UnknownRelationPolicy) []string {
+	if !fromCol {
+		return []string{static}
+	}
+	if len(relationMap) == 0 || policy == UnknownRelationPassthrough {
+		return nil
+	}
+	return mapValues(relationMap)
+}
+
+// mapValues returns the distinct values of m, sorted
+func mapValues(m map[string]string) []string {
+	seen := make(map[string]struct{}, len(m))
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// String identifies the RowMapping in errors and logs
+func (rm RowMapping) String() string {
+	return fmt.Sprintf("%s#%s@%s", rm.ResourceTypeLabel(), rm.RelationLabel(), rm.SubjectTypeLabel())
+}
+
+// Validate checks every RowMapping in the config
+func (c *Config) Validate() error {
+	if c == nil {
+		return fmt.Errorf("config is empty")
+	}
+	for _, t := range c.Tables {
+		for _, rm := range t.Relationships {
+			if err := rm.Validate(); err != nil {
+				return fmt.Errorf("invalid mapping %s for table %s: %w", rm, t.Name, err)
+			}
+		}
+	}
+	return nil
 }
 
 // InternalTableMapping is a TableMapping with table names converted into
 // internal postgres ids, so that it can be used to parse the replication log
 type InternalTableMapping struct {
-	TableID              uint32
+	TableID uint32
+	// TableName is the name of the table in the config
+	TableName string
+	// KeyCols are the positions of the table's replica identity columns
+	KeyCols              []int
 	RelationshipsByColID []InternalRowMapping
 }
 
-// InternalRowMapping is a RowMapping with column names converted into column
-// indexes, so that it can be used to parse the replication log
+// InternalRowMapping is a RowMapping with column names converted into the
+// (0-indexed) positions of the columns in a replicated row, so that it can be
+// used to parse the replication log
 type InternalRowMapping struct {
 	ResourceType   string
 	SubjectType    string
 	Relation       string
 	ResourceIDCols []int
 	SubjectIDCols  []int
+	// SubjectRelation is the static subject relation, if any
+	SubjectRelation string
+	// SubjectRelationCols holds the position of the subject relation column,
+	// if the subject relation comes from a column
+	SubjectRelationCols []int
+	// WildcardWhen is the predicate for wildcard subjects, if any
+	WildcardWhen *InternalPredicate
+	// Filter is the parsed row filter, if any
+	Filter *InternalFilter
+	// RelationCols holds the position of the relation column, if the
+	// relation comes from a column
+	RelationCols    []int
+	RelationMap     map[string]string
+	UnknownRelation UnknownRelationPolicy
+	// ResourceTypeCols and SubjectTypeCols hold the positions of the type
+	// columns, if the types come from columns
+	ResourceTypeCols []int
+	ResourceTypeMap  map[string]string
+	SubjectTypeCols  []int
+	SubjectTypeMap   map[string]string
+}
+
+// ResourceTypes returns the resource types that the InternalRowMapping can
+// generate, sorted if they come from a column
+func (rm InternalRowMapping) ResourceTypes() []string {
+	if len(rm.ResourceTypeCols) == 0 {
+		return []string{rm.ResourceType}
+	}
+	return mapValues(rm.ResourceTypeMap)
+}
+
+// SubjectTypes returns the subject types that the InternalRowMapping can
+// generate, sorted if they come from a column
+func (rm InternalRowMapping) SubjectTypes() []string {
+	if len(rm.SubjectTypeCols) == 0 {
+		return []string{rm.SubjectType}
+	}
+	return mapValues(rm.SubjectTypeMap)
+}
+
+// Relations returns the relations that the InternalRowMapping can generate,
+// or nil if it can generate any relation
+func (rm InternalRowMapping) Relations() []string {
+	return relations(rm.Relation, len(rm.RelationCols) > 0, rm.RelationMap, rm.UnknownRelation)
+}
+
+// InternalFilter is a parsed row filter with the positions and kinds of the
+// columns it depends on
+type InternalFilter struct {
+	Expr  filter.Expr
+	Cols  map[string]int
+	Kinds map[string]filter.Kind
+}
+
+// InternalPredicate is a ColumnPredicate with the column name converted into
+// its position in a replicated row
+type InternalPredicate struct {
+	Col int
+	// Bool is true for boolean columns, whose values are compared after
+	// normalizing their spelling
+	Bool   bool
+	Values []string
 }
@@ -0,0 +1,334 @@
+// Package filter parses the row filters of RowMappings, e.g.
+// `status = 'active' AND deleted_at IS NULL`, so that the same predicate can
+// be pushed into SQL by the importer and evaluated against replicated rows
+// by the follower.
+//
+// Filters are conditions on columns joined with AND and OR, and grouped with
+// parentheses. A condition is one of:
+//
+//	col = value, col <> value, col != value
+//	col < value, col <= value, col > value, col >= value (numeric columns only)
+//	col IN (value, ...), col NOT IN (value, ...)
+//	col IS NULL, col IS NOT NULL
+//
+// where a value is a 'quoted string', a number, TRUE or FALSE. As in SQL, a
+// comparison with a null column never holds.
+//
+// The follower only sees the text of each value, so comparisons are limited
+// to columns whose text compares the way postgres compares their values:
+// text, boolean, integer and numeric columns. Columns of other types, like
+// timestamps or floats, can only be checked for null, see Kind.
+package filter
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Kind is the kind of a column's values, which determines how they are
+// compared with literals
+type Kind int
+
+const (
+	// KindText values are compared as text
+	KindText Kind = iota
+	// KindBool values are compared after normalizing their spelling
+	KindBool
+	// KindNumber values are compared as numbers
+	KindNumber
+	// KindOther values can only be checked for null: their text doesn't
+	// compare the way postgres compares them, e.g. '2021-01-01' and
+	// '2021-01-01 00:00:00' are the same timestamp
+	KindOther
+)
+
+// postgres type ids of the column types that filters can compare
+const (
+	boolOID    = 16
+	nameOID    = 19
+	int8OID    = 20
+	int2OID    = 21
+	int4OID    = 23
+	textOID    = 25
+	oidOID     = 26
+	varcharOID = 1043
+	numericOID = 1700
+)
+
+// KindOf returns how the values of a column with the postgres type oid are
+// compared in filters
+func KindOf(oid uint32) Kind {
+	switch oid {
+	case boolOID:
+		return KindBool
+	case int2OID, int4OID, int8OID, oidOID, numericOID:
+		return KindNumber
+	case textOID, varcharOID, nameOID:
+		return KindText
+	}
+	return KindOther
+}
+
+func (k Kind) String() string {
+	switch k {
+	case KindText:
+		return "text"
+	case KindBool:
+		return "boolean"
+	case KindNumber:
+		return "numeric"
+	default:
+		return "other"
+	}
+}
+
+// Value is the value of a column in a row
+type Value struct {
+	Text string
+	Null bool
+	Kind Kind
+}
+
+// Row returns the value of a column, and false if it isn't known
+type Row func(col string) (Value, bool)
+
+// Expr is a parsed filter
+type Expr interface {
+	// SQL renders the filter as a SQL condition
+	SQL() string
+	// Eval returns whether the filter holds for the row, and false if any
+	// of the columns it depends on are unknown
+	Eval(row Row) (holds bool, ok bool)
+	// Check returns an error if the filter can't be evaluated for columns
+	// of the given kinds
+	Check(kind func(col string) Kind) error
+
+	cols(add func(string))
+}
+
+// Cols returns the columns that the filter depends on
+func Cols(e Expr) []string {
+	seen := make(map[string]struct{})
+	cols := make([]string, 0)
+	e.cols(func(col string) {
+		if _, ok := seen[col]; ok {
+			return
+		}
+		seen[col] = struct{}{}
+		cols = append(cols, col)
+	})
+	return cols
+}
+
+// logical is a list of filters joined with AND or OR
+type logical struct {
+	and   bool
+	exprs []Expr
+}
+
+func (l logical) SQL() string {
+	op := " OR "
+	if l.and {
+		op = " AND "
+	}
+	parts := make([]string, 0, len(l.exprs))
+	for _, e := range l.exprs {
+		parts = append(parts, e.SQL())
+	}
+	return "(" + strings.Join(parts, op) + ")"
+}
+
+func (l logical) Eval(row Row) (bool, bool) {
+	result := l.and
+	for _, e := range l.exprs {
+		holds, ok := e.Eval(row)
+		if !ok {
+			return false, false
+		}
+		if l.and {
+			result = result && holds
+		} else {
+			result = result || holds
+		}
+	}
+	return result, true
+}
+
+func (l logical) Check(kind func(col string) Kind) error {
+	for _, e := range l.exprs {
+		if err := e.Check(kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l logical) cols(add func(string)) {
+	for _, e := range l.exprs {
+		e.cols(add)
+	}
+}
+
+// literal is a value in a filter
+type literal struct {
+	text string
+	kind Kind
+}
+
+func (l literal) SQL() string {
+	switch l.kind {
+	case KindText:
+		return "'" + strings.ReplaceAll(l.text, "'", "''") + "'"
+	case KindBool:
+		return strings.ToUpper(l.text)
+	default:
+		return l.text
+	}
+}
+
+// comparison compares a column with one or more literals
+type comparison struct {
+	col string
+	// op is one of =, <>, <, <=, >, >=, IN and NOT IN
+	op     string
+	values []literal
+}
+
+func (c comparison) SQL() string {
+	values := make([]string, 0, len(c.values))
+	for _, v := range c.values {
+		values = append(values, v.SQL())
+	}
+	col := pgx.Identifier{c.col}.Sanitize()
+	if c.op == "IN" || c.op == "NOT IN" {
+		return fmt.Sprintf("%s %s (%s)", col, c.op, strings.Join(values, ", "))
+	}
+	return fmt.Sprintf("%s %s %s", col, c.op, values[0])
+}
+
+func (c comparison) Eval(row Row) (bool, bool) {
+	v, ok := row(c.col)
+	if !ok {
+		return false, false
+	}
+	if v.Null {
+		return false, true
+	}
+	switch c.op {
+	case "=", "IN":
+		for _, l := range c.values {
+			if compare(v, l) == 0 {
+				return true, true
+			}
+		}
+		return false, true
+	case "<>", "NOT IN":
+		for _, l := range c.values {
+			if compare(v, l) == 0 {
+				return false, true
+			}
+		}
+		return true, true
+	}
+
+	cmp := compare(v, c.values[0])
+	switch c.op {
+	case "<":
+		return cmp < 0, true
+	case "<=":
+		return cmp <= 0, true
+	case ">":
+		return cmp > 0, true
+	default:
+		return cmp >= 0, true
+	}
+}
+
+func (c comparison) Check(kind func(col string) Kind) error {
+	k := kind(c.col)
+	if k == KindOther {
+		return fmt.Errorf("%q can't be compared with values because of its type, only IS NULL and IS NOT NULL can be used with it", c.col)
+	}
+	switch c.op {
+	case "<", "<=", ">", ">=":
+		if k != KindNumber {
+			return fmt.Errorf("%s can only be used with numeric columns, %q is not numeric", c.op, c.col)
+		}
+	}
+	for _, l := range c.values {
+		// strings are untyped in SQL, so they can be compared with any column
+		if l.kind != KindText && l.kind != k {
+			return fmt.Errorf("%q is a %s column and can't be compared with %s", c.col, k, l.SQL())
+		}
+	}
+	return nil
+}
+
+func (c comparison) cols(add func(string)) {
+	add(c.col)
+}
+
+// nullCheck is col IS NULL or col IS NOT NULL
+type nullCheck struct {
+	col string
+	not bool
+}
+
+func (n nullCheck) SQL() string {
+	if n.not {
+		return pgx.Identifier{n.col}.Sanitize() + " IS NOT NULL"
+	}
+	return pgx.Identifier{n.col}.Sanitize() + " IS NULL"
+}
+
+func (n nullCheck) Eval(row Row) (bool, bool) {
+	v, ok := row(n.col)
+	if !ok {
+		return false, false
+	}
+	return v.Null != n.not, true
+}
+
+func (n nullCheck) Check(kind func(col string) Kind) error {
+	return nil
+}
+
+func (n nullCheck) cols(add func(string)) {
+	add(n.col)
+}
+
+// compare compares a column's value with a literal, returning 0 if they are
+// equal, and their order for numbers
+func compare(v Value, l literal) int {
+	switch v.Kind {
+	case KindBool:
+		if NormalizeBool(v.Text) == NormalizeBool(l.text) {
+			return 0
+		}
+		return 1
+	case KindNumber:
+		// numbers are compared exactly, since numeric columns can have more
+		// precision than a float
+		a, aOk := new(big.Rat).SetString(v.Text)
+		b, bOk := new(big.Rat).SetString(l.text)
+		if aOk && bOk {
+			return a.Cmp(b)
+		}
+	}
+	return strings.Compare(v.Text, l.text)
+}
+
+// NormalizeBool converts the spellings of booleans that postgres accepts
+// into the ones that pgoutput sends, t and f. Other values are unchanged.
+func NormalizeBool(v string) string {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "t", "true", "y", "yes", "on", "1":
+		return "t"
+	case "f", "false", "n", "no", "off", "0":
+		return "f"
+	}
+	return v
+}
@@ -0,0 +1,188 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		err    string
+	}{
+		{filter: "", err: "expected a column at position 0, got end of filter"},
+		{filter: "status", err: "expected an operator at position 6, got end of filter"},
+		{filter: "status =", err: "expected a value at position 8, got end of filter"},
+		{filter: "status = active", err: "expected a value at position 9, got \"active\""},
+		{filter: "status = 'active", err: "unterminated ' at position 9"},
+		{filter: "\"status = 'active'", err: "unterminated \" at position 0"},
+		{filter: "a ! 1", err: "unexpected \"!\" at position 2"},
+		{filter: "a = 1.2.3", err: "invalid number \"1.2.3\" at position 4"},
+		{filter: "a = 1;", err: "unexpected ';' at position 5"},
+		{filter: "a = 1 b = 2", err: "unexpected \"b\" at position 6"},
+		{filter: "(a = 1", err: "expected \")\" at position 6, got end of filter"},
+		{filter: "a IS 1", err: "expected NULL at position 5, got \"1\""},
+		{filter: "a NOT 1", err: "expected IN at position 6, got \"1\""},
+		{filter: "a IN 1", err: "expected \"(\" at position 5, got \"1\""},
+		{filter: "a IN (1 2)", err: "expected \",\" or \")\" at position 8, got \"2\""},
+		{filter: "a = 1 AND", err: "expected a column at position 9, got end of filter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			_, err := Parse(tt.filter)
+			require.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestSQL(t *testing.T) {
+	tests := []struct {
+		filter string
+		sql    string
+	}{
+		{filter: "status = 'active'", sql: `"status" = 'active'`},
+		{filter: "Status != 'it''s'", sql: `"status" <> 'it''s'`},
+		{filter: `"Status" = 'a'`, sql: `"Status" = 'a'`},
+		{filter: `"we""ird" = 'a'`, sql: `"we""ird" = 'a'`},
+		{filter: "n >= -1.5", sql: `"n" >= -1.5`},
+		{filter: "flag = true", sql: `"flag" = TRUE`},
+		{filter: "deleted_at is not null", sql: `"deleted_at" IS NOT NULL`},
+		{filter: "deleted_at IS NULL", sql: `"deleted_at" IS NULL`},
+		{filter: "kind in ('a', 'b')", sql: `"kind" IN ('a', 'b')`},
+		{filter: "kind NOT IN (1,2)", sql: `"kind" NOT IN (1, 2)`},
+		// AND binds more tightly than OR
+		{filter: "a = 1 OR b = 2 AND c = 3", sql: `("a" = 1 OR ("b" = 2 AND "c" = 3))`},
+		{filter: "a = 1 AND b = 2 OR c = 3", sql: `(("a" = 1 AND "b" = 2) OR "c" = 3)`},
+		{filter: "(a = 1 OR b = 2) AND c = 3", sql: `(("a" = 1 OR "b" = 2) AND "c" = 3)`},
+		{filter: "a = 1 and b = 2 and c = 3", sql: `("a" = 1 AND "b" = 2 AND "c" = 3)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			e, err := Parse(tt.filter)
+			require.NoError(t, err)
+			require.Equal(t, tt.sql, e.SQL())
+		})
+	}
+}
+
+func TestCols(t *testing.T) {
+	e, err := Parse(`a = 1 AND (b IS NULL OR a = 2 OR "C" IN ('x'))`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "C"}, Cols(e))
+}
+
+func TestEval(t *testing.T) {
+	row := map[string]Value{
+		"status":     {Text: "active", Kind: KindText},
+		"deleted_at": {Null: true, Kind: KindOther},
+		"n":          {Text: "10", Kind: KindNumber},
+		"price":      {Text: "12345678901234567890.10", Kind: KindNumber},
+		"flag":       {Text: "t", Kind: KindBool},
+		"nothing":    {Null: true, Kind: KindText},
+	}
+	lookup := func(col string) (Value, bool) {
+		v, ok := row[col]
+		return v, ok
+	}
+	tests := []struct {
+		filter string
+		holds  bool
+		ok     bool
+	}{
+		{filter: "status = 'active'", holds: true, ok: true},
+		{filter: "status <> 'active'", holds: false, ok: true},
+		{filter: "status IN ('a', 'active')", holds: true, ok: true},
+		{filter: "status NOT IN ('a', 'active')", holds: false, ok: true},
+		{filter: "deleted_at IS NULL", holds: true, ok: true},
+		{filter: "deleted_at IS NOT NULL", holds: false, ok: true},
+		// comparisons with null never hold, whatever the operator
+		{filter: "nothing = 'a'", holds: false, ok: true},
+		{filter: "nothing <> 'a'", holds: false, ok: true},
+		{filter: "nothing NOT IN ('a')", holds: false, ok: true},
+		{filter: "n = 10.0", holds: true, ok: true},
+		{filter: "n > 9", holds: true, ok: true},
+		{filter: "n >= 10", holds: true, ok: true},
+		{filter: "n < 10", holds: false, ok: true},
+		{filter: "n <= -1", holds: false, ok: true},
+		// numbers aren't compared as text, or as floats
+		{filter: "n > 9.5", holds: true, ok: true},
+		{filter: "price > 12345678901234567890.09", holds: true, ok: true},
+		{filter: "price = 12345678901234567890.1", holds: true, ok: true},
+		{filter: "flag = true", holds: true, ok: true},
+		{filter: "flag = 'yes'", holds: true, ok: true},
+		{filter: "flag <> TRUE", holds: false, ok: true},
+		{filter: "flag = false", holds: false, ok: true},
+		{filter: "status = 'active' AND n > 20", holds: false, ok: true},
+		{filter: "status = 'active' OR n > 20", holds: true, ok: true},
+		// unknown columns make the result unknown
+		{filter: "missing = 'a'", holds: false, ok: false},
+		{filter: "missing IS NULL", holds: false, ok: false},
+		{filter: "status = 'active' OR missing = 'a'", holds: false, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			e, err := Parse(tt.filter)
+			require.NoError(t, err)
+			holds, ok := e.Eval(lookup)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.holds, holds)
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	kinds := map[string]Kind{
+		"status":     KindText,
+		"n":          KindNumber,
+		"flag":       KindBool,
+		"created_at": KindOther,
+	}
+	kind := func(col string) Kind { return kinds[col] }
+	tests := []struct {
+		filter string
+		err    string
+	}{
+		{filter: "status = 'a' AND n > 1 AND flag = TRUE"},
+		{filter: "n = '1' AND flag = 'yes'"},
+		{filter: "created_at IS NULL"},
+		{filter: "status > 'a'", err: `> can only be used with numeric columns, "status" is not numeric`},
+		{filter: "flag <= 1", err: `<= can only be used with numeric columns, "flag" is not numeric`},
+		{filter: "created_at = '2021-01-01'", err: `"created_at" can't be compared with values because of its type, only IS NULL and IS NOT NULL can be used with it`},
+		{filter: "n = 1 OR created_at IN ('a')", err: `"created_at" can't be compared with values because of its type, only IS NULL and IS NOT NULL can be used with it`},
+		{filter: "status = 1", err: `"status" is a text column and can't be compared with 1`},
+		{filter: "n IN (1, TRUE)", err: `"n" is a numeric column and can't be compared with TRUE`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			e, err := Parse(tt.filter)
+			require.NoError(t, err)
+			err = e.Check(kind)
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestKindOf(t *testing.T) {
+	require.Equal(t, KindBool, KindOf(boolOID))
+	require.Equal(t, KindNumber, KindOf(int4OID))
+	require.Equal(t, KindNumber, KindOf(numericOID))
+	require.Equal(t, KindText, KindOf(varcharOID))
+	// timestamptz and float8
+	require.Equal(t, KindOther, KindOf(1184))
+	require.Equal(t, KindOther, KindOf(701))
+}
+
+func TestNormalizeBool(t *testing.T) {
+	for _, v := range []string{"t", "TRUE", "yes", "on", "1", " y "} {
+		require.Equal(t, "t", NormalizeBool(v), v)
+	}
+	for _, v := range []string{"f", "False", "no", "OFF", "0", "n"} {
+		require.Equal(t, "f", NormalizeBool(v), v)
+	}
+	require.Equal(t, "maybe", NormalizeBool("maybe"))
+}
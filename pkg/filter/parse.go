@@ -0,0 +1,301 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Parse parses a filter
+func Parse(s string) (Expr, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+	}
+	return e, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenQuotedIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of filter"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// keyword returns whether the token is the (case insensitive) keyword kw
+func (t token) keyword(kw string) bool {
+	return t.kind == tokenIdent && strings.EqualFold(t.text, kw)
+}
+
+func lex(s string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '=':
+			tokens = append(tokens, token{kind: tokenOp, text: "=", pos: i})
+			i++
+		case c == '!' || c == '<' || c == '>':
+			op, width := string(c), 1
+			if i+1 < len(s) {
+				switch s[i : i+2] {
+				case "<=", ">=", "<>":
+					op, width = s[i:i+2], 2
+				case "!=":
+					op, width = "<>", 2
+				}
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected \"!\" at position %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+			i += width
+		case c == '\'' || c == '"':
+			text, n, err := quoted(s[i:], byte(c))
+			if err != nil {
+				return nil, fmt.Errorf("%w at position %d", err, i)
+			}
+			kind := tokenString
+			if c == '"' {
+				kind = tokenQuotedIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: i})
+			i += n
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			start := i
+			i++
+			for i < len(s) && (s[i] == '.' || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			text := s[start:i]
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", text, start)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text, pos: start})
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(s) && (s[i] == '_' || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: s[start:i], pos: start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(s)}), nil
+}
+
+// quoted reads a string quoted with q, in which q is escaped by doubling it,
+// and returns its contents and length including the quotes
+func quoted(s string, q byte) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != q {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == q {
+			b.WriteByte(q)
+			i++
+			continue
+		}
+		return b.String(), i + 1, nil
+	}
+	return "", 0, fmt.Errorf("unterminated %c", q)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("expected %s at position %d, got %s", what, t.pos, t)
+	}
+	return t, nil
+}
+
+// or parses conditions joined with OR, which binds less tightly than AND
+func (p *parser) or() (Expr, error) {
+	return p.logical(false, p.and)
+}
+
+func (p *parser) and() (Expr, error) {
+	return p.logical(true, p.term)
+}
+
+func (p *parser) logical(and bool, operand func() (Expr, error)) (Expr, error) {
+	kw := "OR"
+	if and {
+		kw = "AND"
+	}
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	exprs := []Expr{first}
+	for p.peek().keyword(kw) {
+		p.next()
+		e, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+	if len(exprs) == 1 {
+		return first, nil
+	}
+	return logical{and: and, exprs: exprs}, nil
+}
+
+// term parses a condition or a parenthesized filter
+func (p *parser) term() (Expr, error) {
+	if p.peek().kind == tokenLParen {
+		p.next()
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen, "\")\""); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+
+	t := p.next()
+	var col string
+	switch t.kind {
+	case tokenIdent:
+		// unquoted identifiers are folded to lower case, as in postgres
+		col = strings.ToLower(t.text)
+	case tokenQuotedIdent:
+		col = t.text
+	default:
+		return nil, fmt.Errorf("expected a column at position %d, got %s", t.pos, t)
+	}
+
+	t = p.next()
+	switch {
+	case t.kind == tokenOp:
+		v, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		return comparison{col: col, op: t.text, values: []literal{v}}, nil
+	case t.keyword("IS"):
+		not := false
+		if p.peek().keyword("NOT") {
+			p.next()
+			not = true
+		}
+		if t := p.next(); !t.keyword("NULL") {
+			return nil, fmt.Errorf("expected NULL at position %d, got %s", t.pos, t)
+		}
+		return nullCheck{col: col, not: not}, nil
+	case t.keyword("IN"):
+		values, err := p.list()
+		if err != nil {
+			return nil, err
+		}
+		return comparison{col: col, op: "IN", values: values}, nil
+	case t.keyword("NOT"):
+		if t := p.next(); !t.keyword("IN") {
+			return nil, fmt.Errorf("expected IN at position %d, got %s", t.pos, t)
+		}
+		values, err := p.list()
+		if err != nil {
+			return nil, err
+		}
+		return comparison{col: col, op: "NOT IN", values: values}, nil
+	}
+	return nil, fmt.Errorf("expected an operator at position %d, got %s", t.pos, t)
+}
+
+// list parses a parenthesized list of literals
+func (p *parser) list() ([]literal, error) {
+	if _, err := p.expect(tokenLParen, "\"(\""); err != nil {
+		return nil, err
+	}
+	values := make([]literal, 0)
+	for {
+		v, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		t := p.next()
+		if t.kind == tokenRParen {
+			return values, nil
+		}
+		if t.kind != tokenComma {
+			return nil, fmt.Errorf("expected \",\" or \")\" at position %d, got %s", t.pos, t)
+		}
+	}
+}
+
+func (p *parser) literal() (literal, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokenString:
+		return literal{text: t.text, kind: KindText}, nil
+	case t.kind == tokenNumber:
+		return literal{text: t.text, kind: KindNumber}, nil
+	case t.keyword("TRUE"), t.keyword("FALSE"):
+		return literal{text: strings.ToLower(t.text), kind: KindBool}, nil
+	}
+	return literal{}, fmt.Errorf("expected a value at position %d, got %s", t.pos, t)
+}
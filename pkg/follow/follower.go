@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/authzed/authzed-go/proto/authzed/api/v1"
@@ -16,76 +17,297 @@ import (
 
 	"github.com/authzed/connector-postgresql/pkg/cache"
 	"github.com/authzed/connector-postgresql/pkg/config"
+	"github.com/authzed/connector-postgresql/pkg/filter"
+	"github.com/authzed/connector-postgresql/pkg/metrics"
+	"github.com/authzed/connector-postgresql/pkg/util"
 )
 
-const pgOutputPlugin = "pgoutput"
+const (
+	pgOutputPlugin     = "pgoutput"
+	defaultPublication = "spicedb_sync"
+	// slotTokenBytes is the number of random bytes in temporary slot names
+	slotTokenBytes = 5
+)
+
+// TemporarySlotSuffixLen is the length of the suffix that is added to the
+// name of a temporary slot: an underscore and the random bytes, in hex
+const TemporarySlotSuffixLen = 1 + 2*slotTokenBytes
 
 // Follower is the interface for things that can follow a WAL
 type Follower interface {
 	Follow(ctx context.Context, startingpos pglogrepl.LSN) error
 }
 
+// TruncatePolicy determines what the follower does when a mapped table is
+// truncated
+type TruncatePolicy string
+
+const (
+	// TruncatePolicyApply deletes every relationship generated by the table
+	TruncatePolicyApply TruncatePolicy = "apply"
+	// TruncatePolicyLog logs the truncate but leaves relationships in place
+	TruncatePolicyLog TruncatePolicy = "log"
+	// TruncatePolicyRefuse stops the follower with an error
+	TruncatePolicyRefuse TruncatePolicy = "refuse"
+)
+
+// TruncatePolicies lists the supported truncate policies
+var TruncatePolicies = []TruncatePolicy{TruncatePolicyApply, TruncatePolicyLog, TruncatePolicyRefuse}
+
+// Options configures a WalFollower
+type Options struct {
+	// SlotName is the name of the replication slot. Temporary slots use it
+	// as a prefix for a randomly generated name.
+	SlotName string
+	// TemporarySlot makes the follower use a slot that is dropped when it
+	// stops. Permanent slots are kept so that replication can be resumed
+	// after a restart.
+	TemporarySlot bool
+	// TruncatePolicy is what to do when a mapped table is truncated
+	TruncatePolicy TruncatePolicy
+	// Publication is the name of the publication to subscribe to
+	Publication string
+	// PublicationMode is how the publication is set up, see
+	// PreparePublication
+	PublicationMode PublicationMode
+}
+
 // WalFollower watches the WAL and writes changes into the cache
 type WalFollower struct {
-	conn    *pgconn.PgConn
-	mapping map[uint32][]config.InternalRowMapping
-	cache   *cache.Cache
+	conn     *pgconn.PgConn
+	tables   map[string]config.TableMapping
+	cache    *cache.Cache
+	slotName string
+	slotTemp bool
+	truncate TruncatePolicy
+
+	publication     string
+	publicationMode PublicationMode
+
+	// status is read by health checks from other threads
+	status      sync.Mutex
+	streaming   bool
+	lastMessage time.Time
+
+	// relations holds the mapping for each table that the replication log
+	// has described with a RelationMessage, by relation id
+	relations map[uint32]*config.InternalTableMapping
+	// txn collects the changes of the transaction currently being read
+	txn *cache.Transaction
 }
 
 // NewWalFollower creates a new WalFollower for postgres. The conn must be made
 // with the `replication` flag set.
-func NewWalFollower(conn *pgconn.PgConn, mapping []config.InternalTableMapping, cache *cache.Cache) *WalFollower {
-	tableMap := make(map[uint32][]config.InternalRowMapping, 0)
-	for _, itm := range mapping {
-		tableMap[itm.TableID] = itm.RelationshipsByColID
+// Column names in the mapping are resolved against the table layouts that
+// are sent in the replication log, so the mapping keeps working when mapped
+// tables are altered.
+func NewWalFollower(conn *pgconn.PgConn, mapping []config.TableMapping, cache *cache.Cache, opts Options) *WalFollower {
+	tableMap := make(map[string]config.TableMapping, len(mapping))
+	for _, tm := range mapping {
+		tableMap[tm.Name] = tm
+	}
+	slotName := opts.SlotName
+	if opts.TemporarySlot {
+		slotName = newSlotName(opts.SlotName)
+	}
+	truncate := opts.TruncatePolicy
+	if truncate == "" {
+		truncate = TruncatePolicyApply
+	}
+	publication := opts.Publication
+	if publication == "" {
+		publication = defaultPublication
+	}
+	publicationMode := opts.PublicationMode
+	if publicationMode == "" {
+		publicationMode = PublicationModeCreate
 	}
 	return &WalFollower{
-		conn:    conn,
-		mapping: tableMap,
-		cache:   cache,
+		conn:            conn,
+		tables:          tableMap,
+		relations:       make(map[uint32]*config.InternalTableMapping, 0),
+		cache:           cache,
+		slotName:        slotName,
+		slotTemp:        opts.TemporarySlot,
+		truncate:        truncate,
+		publication:     publication,
+		publicationMode: publicationMode,
+	}
+}
+
+// SlotName returns the name of the replication slot used by the follower
+func (f *WalFollower) SlotName() string {
+	return f.slotName
+}
+
+// SlotExists checks whether the follower's replication slot has already been
+// created, i.e. by a previous run of the connector.
+func (f *WalFollower) SlotExists(ctx context.Context) (bool, error) {
+	results, err := f.conn.Exec(ctx, fmt.Sprintf("SELECT 1 FROM pg_replication_slots WHERE slot_name = '%s';", f.slotName)).ReadAll()
+	if err != nil {
+		return false, err
+	}
+	return len(results) == 1 && len(results[0].Rows) > 0, nil
+}
+
+// CreateSlot creates the follower's replication slot and returns the
+// position in the WAL from which the slot is consistent, along with the name
+// of a snapshot of the database at that position.
+// The snapshot can be used (via SET TRANSACTION SNAPSHOT) to read exactly the
+// data that the slot's changes apply on top of. It is only valid until the
+// follower's connection is used again, i.e. until Follow is called.
+func (f *WalFollower) CreateSlot(ctx context.Context) (pglogrepl.LSN, string, error) {
+	log.Info().Str("slot", f.slotName).Bool("temporary", f.slotTemp).Msg("creating replication slot")
+	result, err := pglogrepl.CreateReplicationSlot(ctx, f.conn, f.slotName, pgOutputPlugin, pglogrepl.CreateReplicationSlotOptions{
+		Temporary:      f.slotTemp,
+		SnapshotAction: "EXPORT_SNAPSHOT",
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	lsn, err := pglogrepl.ParseLSN(result.ConsistentPoint)
+	if err != nil {
+		return 0, "", err
 	}
+	return lsn, result.SnapshotName, nil
+}
+
+// Close closes the follower's replication connection
+func (f *WalFollower) Close(ctx context.Context) error {
+	return f.conn.Close(ctx)
+}
+
+// DropSlot drops the follower's replication slot
+func (f *WalFollower) DropSlot(ctx context.Context) error {
+	log.Info().Str("slot", f.slotName).Msg("dropping replication slot")
+	return pglogrepl.DropReplicationSlot(ctx, f.conn, f.slotName, pglogrepl.DropReplicationSlotOptions{Wait: false})
 }
 
 // Follow starts watching the replication log at startpos. It uses the config's
 // InternalTableMapping to translate WAL events into relationships, which are
-// then written to the cache.
+// grouped by postgres transaction and written to the cache once the
+// transaction commits.
+// The replication slot must already exist, see CreateSlot. Follow returns
+// when ctx is cancelled, after which Shutdown should be called with a new
+// context.
 // Follow (and replication connections in general) are not safe to share across
 // threads. Events should be read from the cache to process them in parallel.
 func (f *WalFollower) Follow(ctx context.Context, startpos pglogrepl.LSN) error {
-	log.Warn().Msg("Replication does not properly support deleting relationships, do not use for production.")
-	publication := "spicedb_sync"
-
-	// TODO: should publication be an arg instead?
-	result := f.conn.Exec(ctx, fmt.Sprintf("DROP PUBLICATION %s;", publication))
-	_, _ = result.ReadAll()
-
-	result = f.conn.Exec(ctx, fmt.Sprintf("CREATE PUBLICATION %s FOR ALL TABLES;", publication))
-	_, err := result.ReadAll()
-	if err != nil {
+	if err := f.startReplication(ctx, startpos); err != nil {
 		return err
 	}
+	return f.stream(ctx, startpos)
+}
 
-	pluginArguments := []string{"proto_version '1'", fmt.Sprintf("publication_names '%s'", publication)}
-
-	slotName := newSlotName("spicedb_sync_slot")
-	_, err = pglogrepl.CreateReplicationSlot(ctx, f.conn, slotName, pgOutputPlugin, pglogrepl.CreateReplicationSlotOptions{Temporary: true})
-	if err != nil {
+// Shutdown ends replication once Follow has returned: it reports the
+// position that has been applied to SpiceDB to postgres, stops the
+// replication stream, and drops the replication slot if it is temporary.
+// Permanent slots are retained so that replication can be resumed.
+func (f *WalFollower) Shutdown(ctx context.Context) error {
+	applied := f.cache.Applied()
+	log.Info().Str("slot", f.slotName).Stringer("applied", applied).Msg("sending final standby status")
+	if err := pglogrepl.SendStandbyStatusUpdate(ctx, f.conn, pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: f.cache.LastReceived(),
+		WALFlushPosition: applied,
+		WALApplyPosition: applied,
+	}); err != nil {
 		return err
 	}
-	err = pglogrepl.StartReplication(ctx, f.conn, slotName, startpos, pglogrepl.StartReplicationOptions{PluginArgs: pluginArguments})
-	if err != nil {
+	metrics.LSN.WithLabelValues(metrics.PositionFlushed).Set(float64(applied))
+	if err := f.stopReplication(ctx); err != nil {
 		return err
 	}
-	defer func() {
-		log.Info().Str("slot", slotName).Msg("dropping replication slot")
-		if err := pglogrepl.DropReplicationSlot(ctx, f.conn, slotName, pglogrepl.DropReplicationSlotOptions{Wait: false}); err != nil {
-			log.Warn().Err(err).Str("slot", slotName).Msg("failed to drop replication slot")
-		} else {
-			log.Info().Str("slot", slotName).Msg("replication slot dropped")
+	if !f.slotTemp {
+		log.Info().Str("slot", f.slotName).Msg("retaining replication slot")
+		return nil
+	}
+	if err := f.DropSlot(ctx); err != nil {
+		return err
+	}
+	log.Info().Str("slot", f.slotName).Msg("replication slot dropped")
+	return nil
+}
+
+// stopReplication ends the replication stream so that the connection can be
+// used for other commands again. Postgres may still send some of the
+// replication log before confirming, which is discarded.
+func (f *WalFollower) stopReplication(ctx context.Context) error {
+	if err := f.conn.SendBytes(ctx, (&pgproto3.CopyDone{}).Encode(nil)); err != nil {
+		return err
+	}
+	for {
+		msg, err := f.conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.ReadyForQuery:
+			return nil
 		}
-	}()
+	}
+}
+
+// Streaming returns whether the follower is currently reading the
+// replication log
+func (f *WalFollower) Streaming() bool {
+	f.status.Lock()
+	defer f.status.Unlock()
+	return f.streaming
+}
+
+// LastMessage returns when the follower last received a message from
+// postgres, either changes or a keepalive
+func (f *WalFollower) LastMessage() time.Time {
+	f.status.Lock()
+	defer f.status.Unlock()
+	return f.lastMessage
+}
 
+func (f *WalFollower) setStreaming(streaming bool) {
+	f.status.Lock()
+	defer f.status.Unlock()
+	f.streaming = streaming
+	if streaming {
+		f.lastMessage = time.Now()
+	}
+}
+
+func (f *WalFollower) received() {
+	f.status.Lock()
+	defer f.status.Unlock()
+	f.lastMessage = time.Now()
+}
+
+// reportLag updates the replication lag with the end of the server's WAL
+func (f *WalFollower) reportLag(serverWALEnd pglogrepl.LSN) {
+	applied := f.cache.Applied()
+	if serverWALEnd < applied {
+		return
+	}
+	metrics.LagBytes.Set(float64(serverWALEnd - applied))
+}
+
+func (f *WalFollower) startReplication(ctx context.Context, startpos pglogrepl.LSN) error {
+	pluginArguments := []string{"proto_version '1'", fmt.Sprintf("publication_names '%s'", f.publication)}
+
+	log.Info().Str("slot", f.slotName).Stringer("startpos", startpos).Msg("starting replication")
+	return pglogrepl.StartReplication(ctx, f.conn, f.slotName, startpos, pglogrepl.StartReplicationOptions{PluginArgs: pluginArguments})
+}
+
+// stream reads the replication log after replication has been started
+func (f *WalFollower) stream(ctx context.Context, startpos pglogrepl.LSN) error {
+	// clientXLogPos is the last position that has been received and written
+	// to the cache. Postgres is only told that WAL has been flushed once the
+	// cache has applied it to spicedb.
 	clientXLogPos := startpos
+	f.cache.Received(startpos)
+	f.txn = nil
+	// postgres describes every relation again when replication starts
+	f.relations = make(map[uint32]*config.InternalTableMapping, 0)
+	f.setStreaming(true)
+	defer f.setStreaming(false)
 	standbyMessageTimeout := time.Second * 10
 	nextStandbyMessageDeadline := time.Now().Add(standbyMessageTimeout)
 	for {
@@ -93,10 +315,20 @@ func (f *WalFollower) Follow(ctx context.Context, startpos pglogrepl.LSN) error
 			return ctx.Err()
 		}
 		if time.Now().After(nextStandbyMessageDeadline) {
-			err = pglogrepl.SendStandbyStatusUpdate(ctx, f.conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: clientXLogPos})
+			applied := f.cache.Applied()
+			log.Debug().Stringer("received", clientXLogPos).Stringer("applied", applied).Msg("sending standby status")
+			err := pglogrepl.SendStandbyStatusUpdate(ctx, f.conn, pglogrepl.StandbyStatusUpdate{
+				WALWritePosition: clientXLogPos,
+				WALFlushPosition: applied,
+				WALApplyPosition: applied,
+				// postgres answers with a keepalive, which shows that the
+				// connection is still alive even when there are no changes
+				ReplyRequested: true,
+			})
 			if err != nil {
 				return err
 			}
+			metrics.LSN.WithLabelValues(metrics.PositionFlushed).Set(float64(applied))
 			nextStandbyMessageDeadline = time.Now().Add(standbyMessageTimeout)
 		}
 
@@ -118,6 +350,8 @@ func (f *WalFollower) Follow(ctx context.Context, startpos pglogrepl.LSN) error
 				if err != nil {
 					return err
 				}
+				f.received()
+				f.reportLag(pkm.ServerWALEnd)
 				if pkm.ReplyRequested {
 					nextStandbyMessageDeadline = time.Time{}
 				}
@@ -127,32 +361,23 @@ func (f *WalFollower) Follow(ctx context.Context, startpos pglogrepl.LSN) error
 				if err != nil {
 					return err
 				}
+				f.received()
+				f.reportLag(xld.ServerWALEnd)
 				log.Trace().Stringer("WALStart", xld.WALStart).Stringer("ServerWALEnd", xld.ServerWALEnd).Time("ServerTime", xld.ServerTime).Str("WALData", string(xld.WALData)).Msg("received XLogData")
 				logicalMsg, err := pglogrepl.Parse(xld.WALData)
 				if err != nil {
 					return err
 				}
-				switch logicalMsg.Type() {
-				case pglogrepl.MessageTypeInsert:
-					insertMsg := logicalMsg.(*pglogrepl.InsertMessage)
-					rels := f.pgTupleToRelationships(insertMsg.RelationID, insertMsg.Tuple)
-					for _, rel := range rels {
-						f.cache.Touch(rel)
-					}
-				case pglogrepl.MessageTypeDelete:
-					// TODO: WARNING: DELETEs need to be handled differently
-					// pgtuples may not contain enough data to convert to spicedbtuples
-					// instead, we need to translate them into deleterelationship requests
-					// that match the filters implied by the row
-					log.Warn().Stringer("type", logicalMsg.Type()).Msg("DELETE is not fully supported by the connector")
-					deleteMsg := logicalMsg.(*pglogrepl.DeleteMessage)
-					rels := f.pgTupleToRelationships(deleteMsg.RelationID, deleteMsg.OldTuple)
-					for _, rel := range rels {
-						f.cache.Delete(rel)
-					}
+				if err := f.handleMessage(xld.WALStart, logicalMsg); err != nil {
+					return err
 				}
 
 				clientXLogPos = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+				// positions inside a transaction aren't received until the
+				// transaction has been committed to the cache
+				if f.txn == nil {
+					f.cache.Received(clientXLogPos)
+				}
 			}
 		default:
 			log.Warn().Str("msg", fmt.Sprintf("%#v", msg)).Msg("received unexpected message")
@@ -160,48 +385,798 @@ func (f *WalFollower) Follow(ctx context.Context, startpos pglogrepl.LSN) error
 	}
 }
 
+// handleMessage adds a logical replication message that starts at walStart
+// in the WAL to the transaction being read, and commits the transaction to
+// the cache when it ends. Errors that reconnecting won't fix are returned as
+// fatalErrors.
+func (f *WalFollower) handleMessage(walStart pglogrepl.LSN, logicalMsg pglogrepl.Message) error {
+	switch msg := logicalMsg.(type) {
+	case *pglogrepl.RelationMessage:
+		if err := f.handleRelation(msg); err != nil {
+			return fatalError{err}
+		}
+	case *pglogrepl.BeginMessage:
+		log.Trace().Uint32("xid", msg.Xid).Stringer("finalLSN", msg.FinalLSN).Msg("begin transaction")
+		f.txn = cache.NewTransaction(walStart)
+	case *pglogrepl.CommitMessage:
+		txn := f.transaction(walStart)
+		txn.CommitLSN = msg.CommitLSN
+		txn.CommitTime = msg.CommitTime
+		log.Trace().Stringer("commitLSN", msg.CommitLSN).Int("operations", txn.Len()).Msg("commit transaction")
+		f.cache.Commit(txn)
+		f.txn = nil
+	case *pglogrepl.InsertMessage:
+		if err := f.checkRelations(msg.RelationID, msg.Tuple.Columns); err != nil {
+			return fatalError{err}
+		}
+		rels := f.pgTupleToRelationships(msg.RelationID, msg.Tuple)
+		txn := f.transaction(walStart)
+		for _, rel := range rels {
+			txn.Touch(rel)
+		}
+	case *pglogrepl.UpdateMessage:
+		if err := f.checkRelations(msg.RelationID, msg.NewTuple.Columns); err != nil {
+			return fatalError{err}
+		}
+		f.handleUpdate(f.transaction(walStart), msg)
+	case *pglogrepl.DeleteMessage:
+		f.handleDelete(f.transaction(walStart), msg)
+	case *pglogrepl.TruncateMessage:
+		if err := f.handleTruncate(f.transaction(walStart), msg); err != nil {
+			return fatalError{err}
+		}
+	}
+	return nil
+}
+
+// handleUpdate compares the relationships generated by the old and new
+// versions of a row, deleting the ones that no longer apply and touching the
+// ones that are new.
+// How much of the old row is available depends on the table's replica
+// identity: with REPLICA IDENTITY FULL the whole old row is sent, otherwise
+// only the key columns are sent (and only if they changed). If the old row is
+// missing columns that a relationship depends on, the old relationship is
+// deleted by a filter built from the columns that are known.
+func (f *WalFollower) handleUpdate(txn *cache.Transaction, msg *pglogrepl.UpdateMessage) {
+	newCols := make([]*pglogrepl.TupleDataColumn, len(msg.NewTuple.Columns))
+	copy(newCols, msg.NewTuple.Columns)
+	f.logTuple(msg.RelationID, newCols)
+
+	var oldCols []*pglogrepl.TupleDataColumn
+	switch {
+	case msg.OldTuple == nil:
+		// the key did not change, so the old key is the same as the new one
+		oldCols = f.keyColumns(msg.RelationID, newCols)
+	case msg.OldTupleType == pglogrepl.UpdateMessageTupleTypeKey:
+		oldCols = f.keyColumns(msg.RelationID, msg.OldTuple.Columns)
+	default:
+		oldCols = msg.OldTuple.Columns
+	}
+
+	// unchanged TOASTed values are not sent in the new tuple, but they may be
+	// available in the old one
+	for i, c := range newCols {
+		if c == nil || c.DataType != pglogrepl.TupleDataTypeToast {
+			continue
+		}
+		newCols[i] = nil
+		if i < len(oldCols) {
+			newCols[i] = oldCols[i]
+		}
+	}
+
+	for _, rm := range f.mapping(msg.RelationID) {
+		newRel, newOk := relationshipFor(rm, newCols)
+		if !newOk {
+			log.Warn().Uint32("relationID", msg.RelationID).Str("relation", rm.Relation).Msg("updated row is missing columns, skipping relationship")
+			continue
+		}
+		oldRel, oldOk := relationshipFor(rm, oldCols)
+		if !oldOk {
+			// the old relationship is resolved from spicedb when the
+			// transaction is applied; if it is newRel, nothing is written
+			f.deleteMatching(txn, msg.RelationID, rm, oldCols)
+			if newRel != nil {
+				txn.Touch(newRel)
+			}
+			continue
+		}
+		if oldRel != nil && newRel != nil && oldRel.String() == newRel.String() {
+			continue
+		}
+		if oldRel != nil {
+			txn.Delete(oldRel)
+		}
+		if newRel != nil {
+			txn.Touch(newRel)
+		}
+	}
+}
+
+// handleDelete deletes the relationships generated by a deleted row. Unless
+// the table has REPLICA IDENTITY FULL, only the key columns of the row are
+// sent; relationships that depend on other columns are deleted by a filter
+// built from the columns that are known.
+func (f *WalFollower) handleDelete(txn *cache.Transaction, msg *pglogrepl.DeleteMessage) {
+	oldCols := msg.OldTuple.Columns
+	if msg.OldTupleType == pglogrepl.DeleteMessageTupleTypeKey {
+		oldCols = f.keyColumns(msg.RelationID, oldCols)
+	}
+	f.logTuple(msg.RelationID, oldCols)
+
+	for _, rm := range f.mapping(msg.RelationID) {
+		rel, ok := relationshipFor(rm, oldCols)
+		if !ok {
+			f.deleteMatching(txn, msg.RelationID, rm, oldCols)
+			continue
+		}
+		if rel != nil {
+			txn.Delete(rel)
+		}
+	}
+}
+
+// handleTruncate deletes every relationship generated by the truncated
+// tables, according to the follower's TruncatePolicy.
+// Relationships are matched on their resource type, relation and subject
+// type, so relationships with the same types that are generated by other
+// tables are deleted as well. The filters are sent to SpiceDB as they are, so
+// truncating a large table doesn't need to read its relationships.
+func (f *WalFollower) handleTruncate(txn *cache.Transaction, msg *pglogrepl.TruncateMessage) error {
+	for _, relationID := range msg.RelationIDs {
+		mapping := f.mapping(relationID)
+		if len(mapping) == 0 {
+			continue
+		}
+		switch f.truncate {
+		case TruncatePolicyRefuse:
+			return fmt.Errorf("mapped table with relation id %d was truncated, refusing to delete its relationships", relationID)
+		case TruncatePolicyLog:
+			log.Warn().Uint32("relationID", relationID).Msg("mapped table was truncated, its relationships were not deleted")
+			continue
+		}
+		for _, rm := range mapping {
+			if other, ok := f.sharedMapping(f.relations[relationID].TableName, rm); ok {
+				log.Warn().Uint32("relationID", relationID).Str("otherTable", other).Str("relation", rm.Relation).Msg("truncate will also delete relationships generated by another table")
+			}
+			relations := relationsFor(rm)
+			for _, resourceType := range rm.ResourceTypes() {
+				for _, relation := range relations {
+					for _, subjectType := range rm.SubjectTypes() {
+						filter := &v1.RelationshipFilter{
+							ResourceType:     resourceType,
+							OptionalRelation: relation,
+							OptionalSubjectFilter: &v1.SubjectFilter{
+								SubjectType: subjectType,
+							},
+						}
+						log.Info().Uint32("relationID", relationID).Str("filter", util.FilterString(filter)).Msg("table truncated, deleting relationships")
+						txn.Truncate(filter)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sharedMapping finds another table in the config with a mapping that
+// generates relationships with the same types as rm, and returns its name
+func (f *WalFollower) sharedMapping(table string, rm config.InternalRowMapping) (string, bool) {
+	for name, tm := range f.tables {
+		if name == table {
+			continue
+		}
+		for _, orm := range tm.Relationships {
+			// mappings that use relation column values as relations match
+			// any relation
+			sameRelation := orm.Relations() == nil || rm.Relations() == nil || overlaps(orm.Relations(), rm.Relations())
+			if sameRelation && overlaps(orm.ResourceTypes(), rm.ResourceTypes()) && overlaps(orm.SubjectTypes(), rm.SubjectTypes()) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// overlaps returns whether a and b have a type in common
+func overlaps(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deleteMatching deletes the relationships generated by rm that match the
+// known columns of a row
+func (f *WalFollower) deleteMatching(txn *cache.Transaction, relationID uint32, rm config.InternalRowMapping, cols []*pglogrepl.TupleDataColumn) {
+	filters, ok := filtersFor(rm, cols)
+	if !ok {
+		log.Warn().Uint32("relationID", relationID).Str("relation", rm.Relation).Msg("row is missing the columns needed to find its relationship, it can't be removed (set REPLICA IDENTITY FULL on the table to fix)")
+		return
+	}
+	for _, filter := range filters {
+		log.Debug().Uint32("relationID", relationID).Str("filter", util.FilterString(filter)).Msg("row is missing columns, deleting relationships by filter")
+		txn.DeleteMatching(filter)
+	}
+}
+
+// handleRelation resolves the row mappings for a table against the table's
+// current layout. Postgres sends a RelationMessage before the first change to
+// each table, and again whenever the table is altered.
+// Columns are resolved by name, and it is an error for a mapped column to be
+// missing from the table.
+func (f *WalFollower) handleRelation(msg *pglogrepl.RelationMessage) error {
+	name := msg.RelationName
+	tm, ok := f.tables[name]
+	if !ok {
+		name = msg.Namespace + "." + msg.RelationName
+		tm = f.tables[name]
+	}
+	itm := &config.InternalTableMapping{
+		TableID:              msg.RelationID,
+		TableName:            name,
+		KeyCols:              make([]int, 0),
+		RelationshipsByColID: make([]config.InternalRowMapping, 0, len(tm.Relationships)),
+	}
+	positions := make(map[string]int, len(msg.Columns))
+	for i, c := range msg.Columns {
+		positions[c.Name] = i
+		// flag 1 marks columns that are part of the replica identity key
+		if c.Flags&1 != 0 {
+			itm.KeyCols = append(itm.KeyCols, i)
+		}
+	}
+
+	colPositions := func(rm config.RowMapping, names []string) ([]int, error) {
+		ids := make([]int, 0, len(names))
+		for _, name := range names {
+			i, ok := positions[name]
+			if !ok {
+				return nil, fmt.Errorf("column %q of table %q, used for %s, does not exist", name, msg.RelationName, rm)
+			}
+			ids = append(ids, i)
+		}
+		return ids, nil
+	}
+	internalPredicate := func(rm config.RowMapping, p config.ColumnPredicate) (*config.InternalPredicate, error) {
+		ids, err := colPositions(rm, []string{p.Col})
+		if err != nil {
+			return nil, err
+		}
+		ip := &config.InternalPredicate{
+			Col:    ids[0],
+			Bool:   filter.KindOf(msg.Columns[ids[0]].DataType) == filter.KindBool,
+			Values: make([]string, 0, len(p.Values)),
+		}
+		for _, v := range p.Values {
+			if ip.Bool {
+				v = filter.NormalizeBool(v)
+			}
+			ip.Values = append(ip.Values, v)
+		}
+		return ip, nil
+	}
+	internalFilter := func(rm config.RowMapping) (*config.InternalFilter, error) {
+		expr, err := rm.ParseFilter()
+		if err != nil || expr == nil {
+			return nil, err
+		}
+		f := &config.InternalFilter{
+			Expr:  expr,
+			Cols:  make(map[string]int),
+			Kinds: make(map[string]filter.Kind),
+		}
+		for _, name := range filter.Cols(expr) {
+			ids, err := colPositions(rm, []string{name})
+			if err != nil {
+				return nil, err
+			}
+			f.Cols[name] = ids[0]
+			f.Kinds[name] = filter.KindOf(msg.Columns[ids[0]].DataType)
+		}
+		if err := expr.Check(func(col string) filter.Kind { return f.Kinds[col] }); err != nil {
+			return nil, fmt.Errorf("filter of %s on table %q: %w", rm, msg.RelationName, err)
+		}
+		return f, nil
+	}
+	for _, rm := range tm.Relationships {
+		resids, err := colPositions(rm, rm.ResourceIDCols)
+		if err != nil {
+			return err
+		}
+		subids, err := colPositions(rm, rm.SubjectIDCols)
+		if err != nil {
+			return err
+		}
+		irm := config.InternalRowMapping{
+			ResourceType:    rm.ResourceType,
+			SubjectType:     rm.SubjectType,
+			Relation:        rm.Relation,
+			ResourceIDCols:  resids,
+			SubjectIDCols:   subids,
+			SubjectRelation: rm.SubjectRelation,
+			ResourceTypeMap: rm.ResourceTypeMap,
+			SubjectTypeMap:  rm.SubjectTypeMap,
+		}
+		if rm.ResourceTypeFromCol != "" {
+			irm.ResourceTypeCols, err = colPositions(rm, []string{rm.ResourceTypeFromCol})
+			if err != nil {
+				return err
+			}
+		}
+		if rm.SubjectTypeFromCol != "" {
+			irm.SubjectTypeCols, err = colPositions(rm, []string{rm.SubjectTypeFromCol})
+			if err != nil {
+				return err
+			}
+		}
+		if rm.SubjectRelationCol != "" {
+			irm.SubjectRelationCols, err = colPositions(rm, []string{rm.SubjectRelationCol})
+			if err != nil {
+				return err
+			}
+		}
+		if rm.WildcardWhen != nil {
+			irm.WildcardWhen, err = internalPredicate(rm, *rm.WildcardWhen)
+			if err != nil {
+				return err
+			}
+		}
+		irm.Filter, err = internalFilter(rm)
+		if err != nil {
+			return err
+		}
+		if rm.RelationFromCol != "" {
+			irm.RelationCols, err = colPositions(rm, []string{rm.RelationFromCol})
+			if err != nil {
+				return err
+			}
+			irm.RelationMap = rm.RelationMap
+			irm.UnknownRelation = rm.UnknownRelation
+		}
+		itm.RelationshipsByColID = append(itm.RelationshipsByColID, irm)
+		if irm.Relations() == nil {
+			log.Warn().Str("table", name).Strs("resourceTypes", irm.ResourceTypes()).Strs("subjectTypes", irm.SubjectTypes()).Msg("relation column values are used as relations, so truncates and deletes by filter delete relationships with any relation between the types")
+		}
+		if !keyCovers(msg.ReplicaIdentity, itm.KeyCols, mappingCols(irm)) {
+			f.logFilterDeletes(name, irm)
+		}
+	}
+
+	if _, ok := f.relations[msg.RelationID]; ok && len(itm.RelationshipsByColID) > 0 {
+		log.Info().Uint32("relationID", msg.RelationID).Str("table", msg.RelationName).Msg("table layout changed, rebuilt mapping")
+	}
+	log.Debug().Uint32("relationID", msg.RelationID).Str("table", msg.RelationName).Int("columns", len(msg.Columns)).Int("mappings", len(itm.RelationshipsByColID)).Msg("received relation")
+	f.relations[msg.RelationID] = itm
+	return nil
+}
+
+// logFilterDeletes warns that updates and deletes of rows that generate
+// relationships with rm may be matched by a filter (see deleteMatching), which
+// can delete relationships that the row didn't generate
+func (f *WalFollower) logFilterDeletes(table string, rm config.InternalRowMapping) {
+	if other, ok := f.sharedMapping(table, rm); ok {
+		log.Warn().Str("table", table).Str("otherTable", other).Str("relation", rm.Relation).Msg("the replica identity doesn't include every mapped column, so updates and deletes can match relationships by filter and delete ones generated by another table (set REPLICA IDENTITY FULL on the table to fix)")
+		return
+	}
+	log.Info().Str("table", table).Str("relation", rm.Relation).Msg("the replica identity doesn't include every mapped column, so updates and deletes can match relationships by filter, including ones with the same types written by others (set REPLICA IDENTITY FULL on the table to avoid this)")
+}
+
+// keyCovers returns whether the old rows sent for updates and deletes
+// include all of cols: with REPLICA IDENTITY FULL the whole row is sent,
+// otherwise only the key columns
+func keyCovers(replicaIdentity uint8, keyCols []int, cols []int) bool {
+	if replicaIdentity == 'f' {
+		return true
+	}
+	for _, c := range cols {
+		found := false
+		for _, k := range keyCols {
+			if c == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// mappingCols returns the positions of every column that rm depends on
+func mappingCols(rm config.InternalRowMapping) []int {
+	cols := make([]int, 0, len(rm.ResourceIDCols)+len(rm.SubjectIDCols))
+	cols = append(cols, rm.ResourceIDCols...)
+	cols = append(cols, rm.SubjectIDCols...)
+	cols = append(cols, rm.SubjectRelationCols...)
+	cols = append(cols, rm.RelationCols...)
+	cols = append(cols, rm.ResourceTypeCols...)
+	cols = append(cols, rm.SubjectTypeCols...)
+	if rm.WildcardWhen != nil {
+		cols = append(cols, rm.WildcardWhen.Col)
+	}
+	if rm.Filter != nil {
+		for _, c := range rm.Filter.Cols {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+// mapping returns the row mappings for a relation
+func (f *WalFollower) mapping(relationID uint32) []config.InternalRowMapping {
+	itm, ok := f.relations[relationID]
+	if !ok {
+		log.Warn().Uint32("relationID", relationID).Msg("received change for a relation that hasn't been described")
+		return nil
+	}
+	return itm.RelationshipsByColID
+}
+
+// transaction returns the transaction that is currently being read from the
+// WAL. pgoutput wraps every change in a transaction, but if a change arrives
+// outside of one, a new transaction is started for it.
+func (f *WalFollower) transaction(lsn pglogrepl.LSN) *cache.Transaction {
+	if f.txn == nil {
+		log.Warn().Stringer("lsn", lsn).Msg("received change outside of a transaction")
+		f.txn = cache.NewTransaction(lsn)
+	}
+	return f.txn
+}
+
+// keyColumns returns a copy of cols that only contains the columns that are
+// part of the table's replica identity key; the others are set to nil.
+func (f *WalFollower) keyColumns(relationID uint32, cols []*pglogrepl.TupleDataColumn) []*pglogrepl.TupleDataColumn {
+	keyCols := make([]*pglogrepl.TupleDataColumn, len(cols))
+	itm, ok := f.relations[relationID]
+	if !ok {
+		return keyCols
+	}
+	for _, i := range itm.KeyCols {
+		if i < len(cols) {
+			keyCols[i] = cols[i]
+		}
+	}
+	return keyCols
+}
+
+// checkRelations returns an error if a new row has a value in a relation
+// column that is not mapped to a relation, for mappings whose policy for
+// unknown values is to fail
+func (f *WalFollower) checkRelations(relationID uint32, cols []*pglogrepl.TupleDataColumn) error {
+	for _, rm := range f.mapping(relationID) {
+		if len(rm.RelationCols) == 0 || rm.UnknownRelation != config.UnknownRelationError {
+			continue
+		}
+		values, ok, null := colValues(rm.RelationCols, cols)
+		if !ok || null {
+			continue
+		}
+		if _, _, err := config.ResolveRelation(values[0], rm.RelationMap, rm.UnknownRelation); err != nil {
+			return fmt.Errorf("relation id %d, relation column %d: %w", relationID, rm.RelationCols[0]+1, err)
+		}
+	}
+	return nil
+}
+
 func (f *WalFollower) pgTupleToRelationships(relationID uint32, data *pglogrepl.TupleData) []*v1.Relationship {
 	cols := data.Columns
+	f.logTuple(relationID, cols)
+
+	rels := make([]*v1.Relationship, 0)
+	for _, rm := range f.mapping(relationID) {
+		rel, ok := relationshipFor(rm, cols)
+		if !ok || rel == nil {
+			continue
+		}
+		rels = append(rels, rel)
+	}
+	return rels
+}
+
+func (f *WalFollower) logTuple(relationID uint32, cols []*pglogrepl.TupleDataColumn) {
 	tlog := log.Trace().Uint32("relationID", relationID)
 	for i, c := range cols {
+		if c == nil {
+			continue
+		}
 		tlog = tlog.Bytes(fmt.Sprintf("col-%d", i+1), c.Data)
 	}
 	tlog.Msg("received tuple")
+}
 
-	rels := make([]*v1.Relationship, 0)
-	for _, rm := range f.mapping[relationID] {
-		rescols := make([]string, 0, len(rm.ResourceIDCols))
-		for _, i := range rm.ResourceIDCols {
-			// column numbers are 1-indexed
-			rescols = append(rescols, string(cols[i-1].Data))
-		}
-		subcols := make([]string, 0, len(rm.SubjectIDCols))
-		for _, i := range rm.SubjectIDCols {
-			// column numbers are 1-indexed
-			subcols = append(subcols, string(cols[i-1].Data))
-		}
-
-		rel := &v1.Relationship{
-			Resource: &v1.ObjectReference{
-				ObjectType: rm.ResourceType,
-				ObjectId:   strings.Join(rescols, "_"),
-			},
-			Relation: rm.Relation,
-			Subject: &v1.SubjectReference{
-				Object: &v1.ObjectReference{
-					ObjectType: rm.SubjectType,
-					ObjectId:   strings.Join(subcols, "_"),
-				},
+// relationshipFor builds the relationship described by rm out of a tuple's
+// columns. Columns that are nil are treated as unknown, and if any of the
+// columns that rm needs are unknown it returns false. If any of the id
+// columns are null, the row doesn't describe a relationship and it returns
+// a nil relationship.
+func relationshipFor(rm config.InternalRowMapping, cols []*pglogrepl.TupleDataColumn) (*v1.Relationship, bool) {
+	rescols, ok, null := colValues(rm.ResourceIDCols, cols)
+	if !ok {
+		return nil, false
+	}
+	subcols, ok, subnull := subjectIDValues(rm, cols)
+	if !ok {
+		return nil, false
+	}
+	if rm.WildcardWhen != nil {
+		holds, ok := predicateHolds(*rm.WildcardWhen, cols)
+		if !ok {
+			return nil, false
+		}
+		if !holds {
+			return nil, true
+		}
+	}
+	if rm.Filter != nil {
+		holds, ok := filterHolds(*rm.Filter, cols)
+		if !ok {
+			return nil, false
+		}
+		if !holds {
+			return nil, true
+		}
+	}
+	relation, ok := relationFor(rm, cols)
+	if !ok {
+		return nil, false
+	}
+	if relation == "" {
+		return nil, true
+	}
+	resourceType, ok := typeFor(rm.ResourceType, rm.ResourceTypeCols, rm.ResourceTypeMap, cols)
+	if !ok {
+		return nil, false
+	}
+	subjectType, ok := typeFor(rm.SubjectType, rm.SubjectTypeCols, rm.SubjectTypeMap, cols)
+	if !ok {
+		return nil, false
+	}
+	if resourceType == "" || subjectType == "" {
+		return nil, true
+	}
+	subrel, ok := subjectRelation(rm, cols)
+	if !ok {
+		return nil, false
+	}
+	if null || subnull {
+		return nil, true
+	}
+	return &v1.Relationship{
+		Resource: &v1.ObjectReference{
+			ObjectType: resourceType,
+			ObjectId:   strings.Join(rescols, "_"),
+		},
+		Relation: relation,
+		Subject: &v1.SubjectReference{
+			Object: &v1.ObjectReference{
+				ObjectType: subjectType,
+				ObjectId:   strings.Join(subcols, "_"),
 			},
+			OptionalRelation: subrel,
+		},
+	}, true
+}
+
+// subjectRelation returns the subject relation described by rm, which is
+// empty if the relation column is null. It returns false if the relation
+// comes from a column that is unknown.
+func subjectRelation(rm config.InternalRowMapping, cols []*pglogrepl.TupleDataColumn) (string, bool) {
+	if len(rm.SubjectRelationCols) == 0 {
+		return rm.SubjectRelation, true
+	}
+	values, ok, null := colValues(rm.SubjectRelationCols, cols)
+	if !ok {
+		return "", false
+	}
+	if null {
+		return "", true
+	}
+	return strings.Join(values, ""), true
+}
+
+// filtersFor builds filters that match the relationship described by rm
+// using whichever of the resource and subject ids can be computed from a
+// tuple's columns. It returns false if neither can be computed. If the row has
+// a null id it doesn't describe a relationship, and there are no filters.
+// Filters need a resource and subject type, so if a type comes from a column
+// that is unknown, there is a filter for each type it can have.
+func filtersFor(rm config.InternalRowMapping, cols []*pglogrepl.TupleDataColumn) ([]*v1.RelationshipFilter, bool) {
+	rescols, resOk, resNull := colValues(rm.ResourceIDCols, cols)
+	subcols, subOk, subNull := subjectIDValues(rm, cols)
+	if !resOk && !subOk {
+		return nil, false
+	}
+	if resNull || subNull {
+		return nil, true
+	}
+	// if the relation comes from a column that is unknown, relationships
+	// with any relation the mapping can generate are matched
+	relation, relOk := relationFor(rm, cols)
+	if relOk && relation == "" {
+		return nil, true
+	}
+	relations := []string{relation}
+	if !relOk {
+		relations = relationsFor(rm)
+	}
+	resourceTypes, ok := typesFor(rm.ResourceTypes(), rm.ResourceTypeCols, rm.ResourceTypeMap, cols)
+	if !ok {
+		return nil, true
+	}
+	subjectTypes, ok := typesFor(rm.SubjectTypes(), rm.SubjectTypeCols, rm.SubjectTypeMap, cols)
+	if !ok {
+		return nil, true
+	}
+	subrel, subrelOk := subjectRelation(rm, cols)
+
+	filters := make([]*v1.RelationshipFilter, 0, len(resourceTypes)*len(relations)*len(subjectTypes))
+	for _, resourceType := range resourceTypes {
+		for _, relation := range relations {
+			for _, subjectType := range subjectTypes {
+				filter := &v1.RelationshipFilter{
+					ResourceType:     resourceType,
+					OptionalRelation: relation,
+					OptionalSubjectFilter: &v1.SubjectFilter{
+						SubjectType: subjectType,
+					},
+				}
+				if resOk {
+					filter.OptionalResourceId = strings.Join(rescols, "_")
+				}
+				if subOk {
+					filter.OptionalSubjectFilter.OptionalSubjectId = strings.Join(subcols, "_")
+				}
+				// the subject relation is only filtered on when it's known, an
+				// empty relation filter would only match plain subjects
+				if subrelOk && subrel != "" {
+					filter.OptionalSubjectFilter.OptionalRelation = &v1.SubjectFilter_RelationFilter{Relation: subrel}
+				}
+				filters = append(filters, filter)
+			}
 		}
-		rels = append(rels, rel)
 	}
-	return rels
+	return filters, true
+}
+
+// relationsFor returns the relations that rm can generate, for filters. If
+// any relation can be generated (passthrough), it returns the empty relation,
+// which matches every relation between the types, including ones that other
+// mappings or writers own. handleRelation warns about such mappings.
+func relationsFor(rm config.InternalRowMapping) []string {
+	relations := rm.Relations()
+	if relations == nil {
+		return []string{""}
+	}
+	return relations
+}
+
+// typeFor returns the static type if there is one, or else the type that the
+// value of the type column maps to, which is empty if the value is null or
+// not in the map. It returns false if the column is unknown.
+func typeFor(static string, typeCols []int, typeMap map[string]string, cols []*pglogrepl.TupleDataColumn) (string, bool) {
+	if len(typeCols) == 0 {
+		return static, true
+	}
+	values, ok, null := colValues(typeCols, cols)
+	if !ok {
+		return "", false
+	}
+	if null {
+		return "", true
+	}
+	return typeMap[values[0]], true
+}
+
+// typesFor returns the types that a relationship described by a row can have:
+// the type from typeFor if the column is known, or else all of them. It
+// returns false if the row can't describe a relationship.
+func typesFor(all []string, typeCols []int, typeMap map[string]string, cols []*pglogrepl.TupleDataColumn) ([]string, bool) {
+	typ, ok := typeFor("", typeCols, typeMap, cols)
+	if len(typeCols) == 0 || !ok {
+		return all, true
+	}
+	if typ == "" {
+		return nil, false
+	}
+	return []string{typ}, true
+}
+
+// relationFor returns the relation of the relationship described by rm, which
+// is empty if the row doesn't describe a relationship. It returns false if
+// the relation comes from a column that is unknown.
+// Unknown values of the column are treated as not describing a relationship
+// whatever the policy; checkRelations catches them in new rows.
+func relationFor(rm config.InternalRowMapping, cols []*pglogrepl.TupleDataColumn) (string, bool) {
+	if len(rm.RelationCols) == 0 {
+		return rm.Relation, true
+	}
+	values, ok, null := colValues(rm.RelationCols, cols)
+	if !ok {
+		return "", false
+	}
+	if null {
+		return "", true
+	}
+	relation, ok, err := config.ResolveRelation(values[0], rm.RelationMap, rm.UnknownRelation)
+	if err != nil || !ok {
+		return "", true
+	}
+	return relation, true
+}
+
+// subjectIDValues is colValues for the subject id columns. Wildcard subjects
+// are always known.
+func subjectIDValues(rm config.InternalRowMapping, cols []*pglogrepl.TupleDataColumn) (values []string, ok bool, null bool) {
+	if rm.WildcardWhen != nil {
+		return []string{"*"}, true, false
+	}
+	return colValues(rm.SubjectIDCols, cols)
+}
+
+// predicateHolds returns whether the predicate holds for a tuple's columns,
+// and false if the column is unknown. It never holds for null values.
+func predicateHolds(p config.InternalPredicate, cols []*pglogrepl.TupleDataColumn) (holds bool, ok bool) {
+	values, ok, null := colValues([]int{p.Col}, cols)
+	if !ok {
+		return false, false
+	}
+	if null {
+		return false, true
+	}
+	value := values[0]
+	if p.Bool {
+		value = filter.NormalizeBool(value)
+	}
+	for _, v := range p.Values {
+		if v == value {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// filterHolds evaluates a row filter against a tuple's columns, and returns
+// false if any of the columns it depends on are unknown
+func filterHolds(f config.InternalFilter, cols []*pglogrepl.TupleDataColumn) (holds bool, ok bool) {
+	return f.Expr.Eval(func(col string) (filter.Value, bool) {
+		values, ok, null := colValues([]int{f.Cols[col]}, cols)
+		if !ok {
+			return filter.Value{}, false
+		}
+		v := filter.Value{Null: null, Kind: f.Kinds[col]}
+		if !null {
+			v.Text = values[0]
+		}
+		return v, true
+	})
+}
+
+// colValues returns the text values of the columns at positions ids in cols, whether they
+// were all known, and whether any of them were null.
+func colValues(ids []int, cols []*pglogrepl.TupleDataColumn) (values []string, ok bool, null bool) {
+	values = make([]string, 0, len(ids))
+	for _, i := range ids {
+		if i < 0 || i >= len(cols) || cols[i] == nil || cols[i].DataType == pglogrepl.TupleDataTypeToast {
+			return nil, false, false
+		}
+		if cols[i].DataType == pglogrepl.TupleDataTypeNull {
+			null = true
+		}
+		values = append(values, string(cols[i].Data))
+	}
+	return values, true, null
 }
 
 // newSlotName can panic and should only be called during process init
 func newSlotName(prefix string) string {
-	token := make([]byte, 5)
+	token := make([]byte, slotTokenBytes)
 	if _, err := rand.Read(token); err != nil {
 		panic("couldn't get random bytes")
 	}
@@ -0,0 +1,442 @@
+package follow
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/require"
+
+	"github.com/authzed/connector-postgresql/pkg/cache"
+	"github.com/authzed/connector-postgresql/pkg/config"
+	"github.com/authzed/connector-postgresql/pkg/util"
+)
+
+// values of tuple columns that aren't text
+const (
+	null  = "<null>"
+	toast = "<unchanged toast>"
+	// unknown columns are missing from the tuple, like the non-key columns
+	// of an old row
+	unknown = "<unknown>"
+)
+
+const (
+	int4OID = 23
+	textOID = 25
+	boolOID = 16
+)
+
+type testCol struct {
+	name string
+	oid  uint32
+	key  bool
+}
+
+func relationMsg(id uint32, table string, replicaIdentity uint8, cols ...testCol) *pglogrepl.RelationMessage {
+	msg := &pglogrepl.RelationMessage{
+		RelationID:      id,
+		Namespace:       "public",
+		RelationName:    table,
+		ReplicaIdentity: replicaIdentity,
+		ColumnNum:       uint16(len(cols)),
+	}
+	for _, c := range cols {
+		var flags uint8
+		if c.key {
+			flags = 1
+		}
+		msg.Columns = append(msg.Columns, &pglogrepl.RelationMessageColumn{Flags: flags, Name: c.name, DataType: c.oid})
+	}
+	return msg
+}
+
+func tuple(values ...string) *pglogrepl.TupleData {
+	t := &pglogrepl.TupleData{ColumnNum: uint16(len(values))}
+	for _, v := range values {
+		switch v {
+		case unknown:
+			t.Columns = append(t.Columns, nil)
+		case null:
+			t.Columns = append(t.Columns, &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeNull})
+		case toast:
+			t.Columns = append(t.Columns, &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeToast})
+		default:
+			t.Columns = append(t.Columns, &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeText, Length: uint32(len(v)), Data: []byte(v)})
+		}
+	}
+	return t
+}
+
+// contactsMapping maps contacts(id, customer_id, note) to
+// contact:<id>#customer@customer:<customer_id>
+var contactsMapping = config.TableMapping{
+	Name: "contacts",
+	Relationships: []config.RowMapping{{
+		ResourceType:   "contact",
+		Relation:       "customer",
+		SubjectType:    "customer",
+		ResourceIDCols: []string{"id"},
+		SubjectIDCols:  []string{"customer_id"},
+	}},
+}
+
+var contactsCols = []testCol{
+	{name: "id", oid: int4OID, key: true},
+	{name: "customer_id", oid: textOID},
+	{name: "note", oid: textOID},
+}
+
+func newTestFollower(t *testing.T, opts Options, mapping ...config.TableMapping) *WalFollower {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewWalFollower(nil, mapping, cache.NewCache(ctx), opts)
+}
+
+// committed returns the transactions that the follower has committed to the
+// cache, and marks them as done
+func committed(f *WalFollower) []*cache.Transaction {
+	txns := make([]*cache.Transaction, 0)
+	for f.cache.Len() > 0 {
+		txn := f.cache.Next()
+		f.cache.Done(txn)
+		txns = append(txns, txn)
+	}
+	return txns
+}
+
+// updateStrings resolves a transaction's updates, reading existing for
+// deletes by filter, and returns them as sorted strings
+func updateStrings(t *testing.T, txn *cache.Transaction, existing ...*v1.Relationship) []string {
+	read := func(ctx context.Context, filter *v1.RelationshipFilter) ([]*v1.Relationship, error) {
+		matches := make([]*v1.Relationship, 0)
+		for _, rel := range existing {
+			if util.FilterMatches(filter, rel) {
+				matches = append(matches, rel)
+			}
+		}
+		return matches, nil
+	}
+	updates, err := txn.Updates(context.Background(), read)
+	require.NoError(t, err)
+	strs := make([]string, 0, len(updates))
+	for _, u := range updates {
+		strs = append(strs, u.Operation.String()+" "+util.RelString(u.Relationship))
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+func contact(id, customerID string) *v1.Relationship {
+	return &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: "contact", ObjectId: id},
+		Relation: "customer",
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "customer", ObjectId: customerID}},
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	f := newTestFollower(t, Options{}, contactsMapping)
+	commitTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	msgs := []pglogrepl.Message{
+		relationMsg(1, "contacts", 'd', contactsCols...),
+		&pglogrepl.BeginMessage{FinalLSN: 200, Xid: 7},
+		&pglogrepl.InsertMessage{RelationID: 1, Tuple: tuple("1", "a", null)},
+		&pglogrepl.InsertMessage{RelationID: 1, Tuple: tuple("2", "b", null)},
+		&pglogrepl.DeleteMessage{RelationID: 1, OldTupleType: pglogrepl.DeleteMessageTupleTypeKey, OldTuple: tuple("3", null, null)},
+	}
+	for i, msg := range msgs {
+		require.NoError(t, f.handleMessage(pglogrepl.LSN(100+i), msg))
+	}
+	// nothing is committed to the cache before the transaction is
+	require.Empty(t, committed(f))
+
+	require.NoError(t, f.handleMessage(200, &pglogrepl.CommitMessage{CommitLSN: 200, CommitTime: commitTime}))
+	txns := committed(f)
+	require.Len(t, txns, 1)
+	require.Equal(t, pglogrepl.LSN(101), txns[0].BeginLSN)
+	require.Equal(t, pglogrepl.LSN(200), txns[0].CommitLSN)
+	require.Equal(t, commitTime, txns[0].CommitTime)
+	require.Equal(t, []string{
+		"OPERATION_DELETE contact:3#customer@customer:c",
+		"OPERATION_TOUCH contact:1#customer@customer:a",
+		"OPERATION_TOUCH contact:2#customer@customer:b",
+	}, updateStrings(t, txns[0], contact("3", "c")))
+
+	// transactions that change no mapped rows are dropped
+	require.NoError(t, f.handleMessage(300, &pglogrepl.BeginMessage{FinalLSN: 310}))
+	require.NoError(t, f.handleMessage(310, &pglogrepl.CommitMessage{CommitLSN: 310}))
+	require.Empty(t, committed(f))
+
+	// a change outside of a transaction starts one
+	require.NoError(t, f.handleMessage(400, &pglogrepl.InsertMessage{RelationID: 1, Tuple: tuple("4", "d", null)}))
+	require.NoError(t, f.handleMessage(410, &pglogrepl.CommitMessage{CommitLSN: 410}))
+	txns = committed(f)
+	require.Len(t, txns, 1)
+	require.Equal(t, pglogrepl.LSN(400), txns[0].BeginLSN)
+	require.Equal(t, []string{"OPERATION_TOUCH contact:4#customer@customer:d"}, updateStrings(t, txns[0]))
+}
+
+func TestRelationshipFor(t *testing.T) {
+	rm := config.InternalRowMapping{
+		ResourceType:   "contact",
+		Relation:       "customer",
+		SubjectType:    "customer",
+		ResourceIDCols: []int{0},
+		SubjectIDCols:  []int{1, 2},
+	}
+	tests := []struct {
+		name string
+		cols []string
+		rel  string
+		ok   bool
+	}{
+		{name: "complete row", cols: []string{"1", "acme", "2"}, rel: "contact:1#customer@customer:acme_2", ok: true},
+		{name: "null id", cols: []string{"1", null, "2"}, ok: true},
+		{name: "unknown column", cols: []string{"1", unknown, "2"}},
+		{name: "unchanged toast", cols: []string{"1", "acme", toast}},
+		{name: "short row", cols: []string{"1", "acme"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rel, ok := relationshipFor(rm, tuple(tt.cols...).Columns)
+			require.Equal(t, tt.ok, ok)
+			if tt.rel == "" {
+				require.Nil(t, rel)
+				return
+			}
+			require.Equal(t, tt.rel, util.RelString(rel))
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name            string
+		replicaIdentity uint8
+		msg             *pglogrepl.UpdateMessage
+		updates         []string
+	}{
+		{
+			name:            "changed subject, key only",
+			replicaIdentity: 'd',
+			msg:             &pglogrepl.UpdateMessage{NewTuple: tuple("1", "b", null)},
+			// the old relationship is found by its resource id
+			updates: []string{
+				"OPERATION_DELETE contact:1#customer@customer:a",
+				"OPERATION_TOUCH contact:1#customer@customer:b",
+			},
+		},
+		{
+			name:            "changed key",
+			replicaIdentity: 'd',
+			msg: &pglogrepl.UpdateMessage{
+				OldTupleType: pglogrepl.UpdateMessageTupleTypeKey,
+				OldTuple:     tuple("1", null, null),
+				NewTuple:     tuple("2", "a", null),
+			},
+			updates: []string{
+				"OPERATION_DELETE contact:1#customer@customer:a",
+				"OPERATION_TOUCH contact:2#customer@customer:a",
+			},
+		},
+		{
+			name:            "changed subject, full row",
+			replicaIdentity: 'f',
+			msg: &pglogrepl.UpdateMessage{
+				OldTupleType: pglogrepl.UpdateMessageTupleTypeOld,
+				OldTuple:     tuple("1", "a", null),
+				NewTuple:     tuple("1", "b", null),
+			},
+			updates: []string{
+				"OPERATION_DELETE contact:1#customer@customer:a",
+				"OPERATION_TOUCH contact:1#customer@customer:b",
+			},
+		},
+		{
+			name:            "unmapped column changed",
+			replicaIdentity: 'f',
+			msg: &pglogrepl.UpdateMessage{
+				OldTupleType: pglogrepl.UpdateMessageTupleTypeOld,
+				OldTuple:     tuple("1", "a", null),
+				NewTuple:     tuple("1", "a", "note"),
+			},
+			updates: []string{},
+		},
+		{
+			name:            "unchanged toast, full row",
+			replicaIdentity: 'f',
+			msg: &pglogrepl.UpdateMessage{
+				OldTupleType: pglogrepl.UpdateMessageTupleTypeOld,
+				OldTuple:     tuple("1", "a", null),
+				NewTuple:     tuple("1", toast, "note"),
+			},
+			// the value is taken from the old row, so nothing changed
+			updates: []string{},
+		},
+		{
+			name:            "unchanged toast, key only",
+			replicaIdentity: 'd',
+			msg:             &pglogrepl.UpdateMessage{NewTuple: tuple("1", toast, "note")},
+			// the new relationship can't be built, so it is left alone
+			updates: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFollower(t, Options{}, contactsMapping)
+			require.NoError(t, f.handleMessage(100, relationMsg(1, "contacts", tt.replicaIdentity, contactsCols...)))
+			tt.msg.RelationID = 1
+			txn := cache.NewTransaction(101)
+			f.handleUpdate(txn, tt.msg)
+			require.Equal(t, tt.updates, updateStrings(t, txn, contact("1", "a")))
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		policy    TruncatePolicy
+		truncates []string
+		err       bool
+	}{
+		{policy: TruncatePolicyApply, truncates: []string{"contact:*#customer@customer:*"}},
+		{policy: TruncatePolicyLog, truncates: []string{}},
+		{policy: TruncatePolicyRefuse, truncates: []string{}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			f := newTestFollower(t, Options{TruncatePolicy: tt.policy}, contactsMapping)
+			require.NoError(t, f.handleMessage(100, relationMsg(1, "contacts", 'd', contactsCols...)))
+			require.NoError(t, f.handleMessage(101, relationMsg(2, "notes", 'd', testCol{name: "id", oid: int4OID, key: true})))
+
+			// unmapped tables can be truncated whatever the policy
+			txn := cache.NewTransaction(102)
+			require.NoError(t, f.handleTruncate(txn, &pglogrepl.TruncateMessage{RelationNum: 1, RelationIDs: []uint32{2}}))
+			require.Empty(t, txn.Truncates())
+
+			err := f.handleMessage(103, &pglogrepl.TruncateMessage{RelationNum: 2, RelationIDs: []uint32{2, 1}})
+			if tt.err {
+				var fatal fatalError
+				require.ErrorAs(t, err, &fatal)
+				return
+			}
+			require.NoError(t, err)
+			truncates := make([]string, 0)
+			for _, filter := range f.txn.Truncates() {
+				truncates = append(truncates, util.FilterString(filter))
+			}
+			require.Equal(t, tt.truncates, truncates)
+		})
+	}
+}
+
+func TestWildcardUpdates(t *testing.T) {
+	documents := config.TableMapping{
+		Name: "documents",
+		Relationships: []config.RowMapping{{
+			ResourceType:   "document",
+			Relation:       "viewer",
+			SubjectType:    "user",
+			ResourceIDCols: []string{"id"},
+			WildcardWhen:   &config.ColumnPredicate{Col: "is_public", Values: []string{"true"}},
+		}},
+	}
+	f := newTestFollower(t, Options{}, documents)
+	require.NoError(t, f.handleMessage(100, relationMsg(1, "documents", 'd', testCol{name: "id", oid: int4OID, key: true}, testCol{name: "is_public", oid: boolOID})))
+	public := &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: "document", ObjectId: "1"},
+		Relation: "viewer",
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "*"}},
+	}
+
+	// boolean values are compared however postgres spells them
+	rel, ok := relationshipFor(f.mapping(1)[0], tuple("1", "t").Columns)
+	require.True(t, ok)
+	require.Equal(t, "document:1#viewer@user:*", util.RelString(rel))
+	rel, ok = relationshipFor(f.mapping(1)[0], tuple("1", "f").Columns)
+	require.True(t, ok)
+	require.Nil(t, rel)
+
+	txn := cache.NewTransaction(101)
+	f.handleUpdate(txn, &pglogrepl.UpdateMessage{RelationID: 1, NewTuple: tuple("1", "t")})
+	require.Equal(t, []string{"OPERATION_TOUCH document:1#viewer@user:*"}, updateStrings(t, txn))
+
+	// the old value isn't sent, so the wildcard is found by filter
+	txn = cache.NewTransaction(102)
+	f.handleUpdate(txn, &pglogrepl.UpdateMessage{RelationID: 1, NewTuple: tuple("1", "f")})
+	require.Equal(t, []string{"OPERATION_DELETE document:1#viewer@user:*"}, updateStrings(t, txn, public))
+}
+
+func TestTypesFor(t *testing.T) {
+	typeMap := map[string]string{"Post": "post", "Photo": "photo"}
+	all := []string{"photo", "post"}
+	tests := []struct {
+		name     string
+		typeCols []int
+		cols     []string
+		types    []string
+		ok       bool
+	}{
+		{name: "static type", cols: []string{"Post"}, types: all, ok: true},
+		{name: "mapped value", typeCols: []int{0}, cols: []string{"Post"}, types: []string{"post"}, ok: true},
+		{name: "unknown column", typeCols: []int{0}, cols: []string{unknown}, types: all, ok: true},
+		{name: "unmapped value", typeCols: []int{0}, cols: []string{"Video"}},
+		{name: "null value", typeCols: []int{0}, cols: []string{null}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			types, ok := typesFor(all, tt.typeCols, typeMap, tuple(tt.cols...).Columns)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.types, types)
+		})
+	}
+}
+
+func TestFiltersFor(t *testing.T) {
+	// comments(id, commentable_type, commentable_id)
+	rm := config.InternalRowMapping{
+		ResourceType:    "comment",
+		Relation:        "commentable",
+		ResourceIDCols:  []int{0},
+		SubjectIDCols:   []int{2},
+		SubjectTypeCols: []int{1},
+		SubjectTypeMap:  map[string]string{"Post": "post", "Photo": "photo"},
+	}
+	tests := []struct {
+		name    string
+		cols    []string
+		filters []string
+		ok      bool
+	}{
+		{name: "complete row", cols: []string{"1", "Post", "5"}, filters: []string{"comment:1#commentable@post:5"}, ok: true},
+		{
+			name: "key only",
+			cols: []string{"1", unknown, unknown},
+			// a filter for each type the subject can have
+			filters: []string{"comment:1#commentable@photo:*", "comment:1#commentable@post:*"},
+			ok:      true,
+		},
+		{name: "subject only", cols: []string{unknown, "Photo", "5"}, filters: []string{"comment:*#commentable@photo:5"}, ok: true},
+		{name: "no ids", cols: []string{unknown, "Post", unknown}},
+		{name: "null id", cols: []string{"1", "Post", null}, filters: []string{}, ok: true},
+		{name: "unmapped type", cols: []string{"1", "Video", unknown}, filters: []string{}, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters, ok := filtersFor(rm, tuple(tt.cols...).Columns)
+			require.Equal(t, tt.ok, ok)
+			if !ok {
+				return
+			}
+			strs := make([]string, 0, len(filters))
+			for _, filter := range filters {
+				strs = append(strs, util.FilterString(filter))
+			}
+			require.Equal(t, tt.filters, strs)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package follow
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// PublicationMode determines how the follower gets the publication it
+// subscribes to
+type PublicationMode string
+
+const (
+	// PublicationModeCreate creates the publication for the mapped tables if
+	// it doesn't exist, and adds any mapped tables that it is missing
+	PublicationModeCreate PublicationMode = "create"
+	// PublicationModeExisting uses an existing publication without changing it
+	PublicationModeExisting PublicationMode = "existing"
+)
+
+// PublicationModes lists the supported publication modes
+var PublicationModes = []PublicationMode{PublicationModeCreate, PublicationModeExisting}
+
+// PreparePublication makes sure the publication that the follower subscribes
+// to exists and publishes every mapped table. Depending on the publication
+// mode it is created or only checked. It must be called before the
+// replication slot is created.
+func (f *WalFollower) PreparePublication(ctx context.Context) error {
+	if len(f.tables) == 0 {
+		return fmt.Errorf("no tables are mapped, nothing to publish")
+	}
+	published, exists, err := f.publishedTables(ctx)
+	if err != nil {
+		return err
+	}
+	missing := f.unpublishedTables(published)
+
+	if f.publicationMode == PublicationModeCreate {
+		switch {
+		case !exists:
+			log.Info().Str("publication", f.publication).Strs("tables", missing).Msg("creating publication")
+			if err := f.exec(ctx, fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s;", pgx.Identifier{f.publication}.Sanitize(), tableList(missing))); err != nil {
+				return err
+			}
+		case len(missing) > 0:
+			log.Info().Str("publication", f.publication).Strs("tables", missing).Msg("adding tables to publication")
+			if err := f.exec(ctx, fmt.Sprintf("ALTER PUBLICATION %s ADD TABLE %s;", pgx.Identifier{f.publication}.Sanitize(), tableList(missing))); err != nil {
+				return err
+			}
+		}
+		published, exists, err = f.publishedTables(ctx)
+		if err != nil {
+			return err
+		}
+		missing = f.unpublishedTables(published)
+	}
+
+	if !exists {
+		return fmt.Errorf("publication %q does not exist", f.publication)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("publication %q does not publish mapped tables %v", f.publication, missing)
+	}
+	return nil
+}
+
+// publishedTables returns the tables in the follower's publication, both by
+// name and by schema qualified name, and whether the publication exists
+func (f *WalFollower) publishedTables(ctx context.Context) (map[string]struct{}, bool, error) {
+	// replication connections only support the simple query protocol, so
+	// the name is quoted instead of passed as a parameter
+	name := strings.ReplaceAll(f.publication, "'", "''")
+	results, err := f.conn.Exec(ctx, fmt.Sprintf(
+		"SELECT p.pubname, t.schemaname, t.tablename FROM pg_publication p LEFT JOIN pg_publication_tables t ON t.pubname = p.pubname WHERE p.pubname = '%s';", name,
+	)).ReadAll()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(results) != 1 || len(results[0].Rows) == 0 {
+		return nil, false, nil
+	}
+	tables := make(map[string]struct{}, len(results[0].Rows)*2)
+	for _, row := range results[0].Rows {
+		if row[1] == nil || row[2] == nil {
+			continue
+		}
+		tables[string(row[2])] = struct{}{}
+		tables[string(row[1])+"."+string(row[2])] = struct{}{}
+	}
+	return tables, true, nil
+}
+
+// unpublishedTables returns the mapped tables that are not in published
+func (f *WalFollower) unpublishedTables(published map[string]struct{}) []string {
+	missing := make([]string, 0)
+	for name := range f.tables {
+		if _, ok := published[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func (f *WalFollower) exec(ctx context.Context, sql string) error {
+	_, err := f.conn.Exec(ctx, sql).ReadAll()
+	return err
+}
+
+// tableList quotes a list of (optionally schema qualified) table names
+func tableList(tables []string) string {
+	quoted := make([]string, 0, len(tables))
+	for _, t := range tables {
+		quoted = append(quoted, pgx.Identifier(strings.Split(t, ".")).Sanitize())
+	}
+	return strings.Join(quoted, ", ")
+}
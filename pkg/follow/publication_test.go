@@ -0,0 +1,46 @@
+package follow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/authzed/connector-postgresql/pkg/config"
+)
+
+func TestUnpublishedTables(t *testing.T) {
+	f := newTestFollower(t, Options{},
+		config.TableMapping{Name: "contacts"},
+		config.TableMapping{Name: "billing.invoices"},
+		config.TableMapping{Name: "article_tag"},
+	)
+	// published tables are listed by name and by schema qualified name
+	published := map[string]struct{}{
+		"contacts":        {},
+		"public.contacts": {},
+		"invoices":        {},
+		"public.invoices": {},
+	}
+	require.Equal(t, []string{"article_tag", "billing.invoices"}, f.unpublishedTables(published))
+	require.Equal(t, []string{"article_tag", "billing.invoices", "contacts"}, f.unpublishedTables(nil))
+}
+
+func TestTableList(t *testing.T) {
+	require.Equal(t, `"contacts", "billing"."invoices", "Weird ""Name"""`, tableList([]string{"contacts", "billing.invoices", `Weird "Name"`}))
+}
+
+func TestPublicationDefaults(t *testing.T) {
+	f := newTestFollower(t, Options{}, contactsMapping)
+	require.Equal(t, defaultPublication, f.publication)
+	require.Equal(t, PublicationModeCreate, f.publicationMode)
+
+	f = newTestFollower(t, Options{Publication: "mine", PublicationMode: PublicationModeExisting}, contactsMapping)
+	require.Equal(t, "mine", f.publication)
+	require.Equal(t, PublicationModeExisting, f.publicationMode)
+}
+
+func TestPreparePublicationWithoutTables(t *testing.T) {
+	f := newTestFollower(t, Options{})
+	require.EqualError(t, f.PreparePublication(context.Background()), "no tables are mapped, nothing to publish")
+}
@@ -0,0 +1,97 @@
+package follow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// ConnectFunc opens a new replication connection to postgres
+type ConnectFunc func(ctx context.Context) (*pgconn.PgConn, error)
+
+// fatalError wraps replication errors that reconnecting won't fix, such as a
+// mapped column being dropped
+type fatalError struct {
+	error
+}
+
+func (e fatalError) Unwrap() error {
+	return e.error
+}
+
+// Supervisor keeps a WalFollower running. When replication fails it
+// reconnects with exponential backoff and resumes from the last position that
+// was added to the cache. Postgres keeps the WAL after the last position
+// confirmed as applied, and everything in between is still in the cache, so
+// no changes are lost or applied twice.
+type Supervisor struct {
+	follower    *WalFollower
+	connect     ConnectFunc
+	retryWindow time.Duration
+}
+
+// NewSupervisor returns a Supervisor for the follower. It gives up if
+// replication can't be resumed within retryWindow.
+func NewSupervisor(follower *WalFollower, connect ConnectFunc, retryWindow time.Duration) *Supervisor {
+	return &Supervisor{
+		follower:    follower,
+		connect:     connect,
+		retryWindow: retryWindow,
+	}
+}
+
+// Run follows the replication log from startpos until ctx is cancelled, or
+// until replication fails and can't be resumed. Temporary replication slots
+// are dropped when their connection is lost, so replication can only be
+// resumed with permanent slots.
+func (s *Supervisor) Run(ctx context.Context, startpos pglogrepl.LSN) error {
+	err := s.follower.Follow(ctx, startpos)
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		var fatal fatalError
+		if errors.As(err, &fatal) {
+			return err
+		}
+		if s.follower.slotTemp {
+			return fmt.Errorf("replication stopped and temporary replication slots can't be resumed: %w", err)
+		}
+		pos := s.follower.cache.LastReceived()
+		log.Warn().Err(err).Str("slot", s.follower.slotName).Stringer("lsn", pos).Msg("replication stopped, reconnecting")
+		if err := s.reconnect(ctx, pos); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to resume replication within %s: %w", s.retryWindow, err)
+		}
+		log.Info().Str("slot", s.follower.slotName).Stringer("lsn", pos).Msg("replication resumed")
+		err = s.follower.stream(ctx, pos)
+	}
+}
+
+func (s *Supervisor) reconnect(ctx context.Context, pos pglogrepl.LSN) error {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = s.retryWindow
+	return backoff.RetryNotify(func() error {
+		if s.follower.conn != nil {
+			closeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			_ = s.follower.conn.Close(closeCtx)
+			cancel()
+		}
+		conn, err := s.connect(ctx)
+		if err != nil {
+			return err
+		}
+		s.follower.conn = conn
+		return s.follower.startReplication(ctx, pos)
+	}, backoff.WithContext(b, ctx), func(err error, next time.Duration) {
+		log.Warn().Err(err).Dur("retryIn", next).Msg("failed to resume replication")
+	})
+}
@@ -0,0 +1,90 @@
+// Package health serves liveness and readiness checks over http.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Check returns an error if the checked component is unhealthy
+type Check func() error
+
+// Checker holds named liveness and readiness checks. It is safe to use from
+// multiple threads.
+type Checker struct {
+	sync.Mutex
+	liveness  map[string]Check
+	readiness map[string]Check
+}
+
+// NewChecker returns a Checker without any checks, which is both live and
+// ready
+func NewChecker() *Checker {
+	return &Checker{
+		liveness:  make(map[string]Check, 0),
+		readiness: make(map[string]Check, 0),
+	}
+}
+
+// AddLivenessCheck adds a check that must pass for the process to be live
+func (c *Checker) AddLivenessCheck(name string, check Check) {
+	c.Lock()
+	defer c.Unlock()
+	c.liveness[name] = check
+}
+
+// AddReadinessCheck adds a check that must pass for the process to be ready
+func (c *Checker) AddReadinessCheck(name string, check Check) {
+	c.Lock()
+	defer c.Unlock()
+	c.readiness[name] = check
+}
+
+// LivenessHandler serves the result of the liveness checks, for /healthz
+func (c *Checker) LivenessHandler() http.Handler {
+	return c.handler(func() map[string]Check { return c.liveness })
+}
+
+// ReadinessHandler serves the result of the readiness checks, for /readyz
+func (c *Checker) ReadinessHandler() http.Handler {
+	return c.handler(func() map[string]Check { return c.readiness })
+}
+
+// handler responds with 200 if all checks pass and 503 otherwise, listing
+// the result of each check
+func (c *Checker) handler(checks func() map[string]Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Lock()
+		names := make([]string, 0, len(checks()))
+		byName := make(map[string]Check, len(checks()))
+		for name, check := range checks() {
+			names = append(names, name)
+			byName[name] = check
+		}
+		c.Unlock()
+		sort.Strings(names)
+
+		healthy := true
+		var body strings.Builder
+		for _, name := range names {
+			if err := byName[name](); err != nil {
+				healthy = false
+				fmt.Fprintf(&body, "[-] %s: %s\n", name, err)
+				continue
+			}
+			fmt.Fprintf(&body, "[+] %s ok\n", name)
+		}
+
+		if len(names) == 0 {
+			body.WriteString("ok\n")
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, body.String())
+	})
+}
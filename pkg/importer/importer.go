@@ -4,15 +4,28 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 
 	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/rs/zerolog/log"
 
+	"github.com/authzed/connector-postgresql/pkg/checkpoint"
 	"github.com/authzed/connector-postgresql/pkg/config"
+	"github.com/authzed/connector-postgresql/pkg/filter"
+	"github.com/authzed/connector-postgresql/pkg/metrics"
 	"github.com/authzed/connector-postgresql/pkg/write"
 )
 
+const (
+	// chunkSize is the number of rows fetched from postgres, and the number
+	// of relationships written to SpiceDB, at a time
+	chunkSize = 1000
+	// cursorName is the name of the cursor that rows are fetched from
+	cursorName = "connector_import"
+)
+
 // Importer is an interface satisfied by anything that can import data into
 // SpiceDB
 type Importer interface {
@@ -22,93 +35,463 @@ type Importer interface {
 // PostgresImporter will import data from postgres into SpiceDB. It knows how
 // to convert data into relationships with its TableMapping.
 type PostgresImporter struct {
-	conn    *pgxpool.Pool
-	writer  write.RelationshipWriter
-	mapping []config.TableMapping
+	conn        *pgxpool.Pool
+	writer      write.RelationshipWriter
+	mapping     []config.TableMapping
+	snapshot    string
+	primaryKeys map[string][]string
+	store       checkpoint.ImportStore
+	resume      bool
+	workers     int
+	keyRanges   int
+
+	// mu guards progress, scanned and written, which are shared by the
+	// workers
+	mu       sync.Mutex
+	progress checkpoint.ImportProgress
+	// scanned counts the rows read, and written the relationships written,
+	// by table
+	scanned map[string]int
+	written map[string]int
 }
 
 var _ Importer = &PostgresImporter{}
 
+// Option configures optional behavior of a PostgresImporter
+type Option func(i *PostgresImporter)
+
+// WithSnapshot makes the importer read from an exported postgres snapshot, so
+// that the imported data matches a known point in the replication log.
+func WithSnapshot(name string) Option {
+	return func(i *PostgresImporter) {
+		i.snapshot = name
+	}
+}
+
+// WithPrimaryKeys makes the importer page through tables by their primary
+// key columns, by table name, instead of reading them with a cursor. Import
+// progress can only be resumed for tables with a primary key.
+func WithPrimaryKeys(keys map[string][]string) Option {
+	return func(i *PostgresImporter) {
+		i.primaryKeys = keys
+	}
+}
+
+// WithProgress makes the importer record its progress in store. If resume is
+// true, tables and mappings that were completed by an earlier import are
+// skipped, and partially imported ones continue after the last row that was
+// written.
+func WithProgress(store checkpoint.ImportStore, resume bool) Option {
+	return func(i *PostgresImporter) {
+		i.store = store
+		i.resume = resume
+	}
+}
+
+// WithConcurrency makes the importer import up to workers tables and
+// mappings at the same time. Tables with a primary key are split into
+// keyRanges ranges of keys of about the same size, which are imported in
+// parallel too. All workers read from the same snapshot of the database.
+func WithConcurrency(workers, keyRanges int) Option {
+	return func(i *PostgresImporter) {
+		i.workers = workers
+		i.keyRanges = keyRanges
+	}
+}
+
 // NewPostgresImporter returns a new instance of a postgres importer
-func NewPostgresImporter(conn *pgxpool.Pool, writer write.RelationshipWriter, mapping []config.TableMapping) *PostgresImporter {
-	return &PostgresImporter{
-		conn:    conn,
-		writer:  writer,
-		mapping: mapping,
+func NewPostgresImporter(conn *pgxpool.Pool, writer write.RelationshipWriter, mapping []config.TableMapping, opts ...Option) *PostgresImporter {
+	i := &PostgresImporter{
+		conn:        conn,
+		writer:      writer,
+		mapping:     mapping,
+		primaryKeys: make(map[string][]string, 0),
+		workers:     1,
+		keyRanges:   1,
+		progress:    make(checkpoint.ImportProgress, 0),
+		scanned:     make(map[string]int, 0),
+		written:     make(map[string]int, 0),
+	}
+	for _, o := range opts {
+		o(i)
 	}
+	return i
 }
 
-// Import walks through each table in the config and writes relationships
+// Import walks through each table in the config and writes relationships.
+// All tables are read in repeatable read transactions that share a snapshot,
+// so that the import reflects one consistent state of the database.
 func (i *PostgresImporter) Import(ctx context.Context) error {
-	for _, m := range i.mapping {
-		log.Info().Str("table", m.Name).Msg("writing relationships")
-		if err := i.importTable(ctx, m); err != nil {
+	if i.store != nil && i.resume {
+		progress, err := i.store.Load(ctx)
+		if err != nil {
 			return err
 		}
+		i.progress = progress
+		log.Info().Int("mappings", len(i.progress)).Msg("resuming import")
+	}
+
+	tx, err := i.begin(ctx, i.snapshot)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := checkFilters(ctx, tx, i.mapping); err != nil {
+		return err
 	}
+
+	jobs, err := i.jobs(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if i.workers <= 1 {
+		for _, j := range jobs {
+			if err := i.importRelationships(ctx, tx, j); err != nil {
+				return err
+			}
+		}
+		i.logSummary()
+		return nil
+	}
+
+	// the workers' transactions read from a snapshot of this one, which
+	// must stay open until they have started
+	snapshot := i.snapshot
+	if snapshot == "" {
+		if err := tx.QueryRow(ctx, "SELECT pg_export_snapshot();").Scan(&snapshot); err != nil {
+			return err
+		}
+	}
+	if err := i.runWorkers(ctx, snapshot, jobs); err != nil {
+		return err
+	}
+	i.logSummary()
 	return nil
 }
 
-func (i *PostgresImporter) importTable(ctx context.Context, tableMap config.TableMapping) error {
-	for _, rm := range tableMap.Relationships {
-		if err := i.importRelationships(ctx, tableMap.Name, rm); err != nil {
-			return err
+// checkFilters returns an error if a mapping's filter compares a column that
+// the follower can't compare the way postgres does, so that the import and
+// replication never disagree about which rows match. It reads the types of
+// the columns without reading any rows.
+func checkFilters(ctx context.Context, tx pgx.Tx, mapping []config.TableMapping) error {
+	for _, t := range mapping {
+		for _, rm := range t.Relationships {
+			expr, err := rm.ParseFilter()
+			if err != nil {
+				return fmt.Errorf("invalid filter for %s: %w", rm, err)
+			}
+			if expr == nil {
+				continue
+			}
+			cols := filter.Cols(expr)
+			quoted := make([]string, 0, len(cols))
+			for _, col := range cols {
+				quoted = append(quoted, pgx.Identifier{col}.Sanitize())
+			}
+			rows, err := tx.Query(ctx, fmt.Sprintf("SELECT %s FROM %s LIMIT 0;", strings.Join(quoted, ","), t.Name))
+			if err != nil {
+				return fmt.Errorf("filter of %s on table %q: %w", rm, t.Name, err)
+			}
+			kinds := make(map[string]filter.Kind, len(cols))
+			for n, fd := range rows.FieldDescriptions() {
+				kinds[cols[n]] = filter.KindOf(fd.DataTypeOID)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			if err := expr.Check(func(col string) filter.Kind { return kinds[col] }); err != nil {
+				return fmt.Errorf("filter of %s on table %q: %w", rm, t.Name, err)
+			}
 		}
 	}
 	return nil
 }
 
-func (i *PostgresImporter) importRelationships(ctx context.Context, table string, rm config.RowMapping) error {
-	relupdates, err := i.relationshipsFor(ctx, table, rm)
+// begin starts a read only, repeatable read transaction, reading from the
+// snapshot if there is one
+func (i *PostgresImporter) begin(ctx context.Context, snapshot string) (pgx.Tx, error) {
+	tx, err := i.conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != "" {
+		log.Debug().Str("snapshot", snapshot).Msg("importing from snapshot")
+		if _, err := tx.Exec(ctx, setSnapshot(snapshot)); err != nil {
+			_ = tx.Rollback(ctx)
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// setSnapshot is the statement that makes a transaction read from an exported
+// snapshot. It must be the first statement of the transaction.
+func setSnapshot(snapshot string) string {
+	return fmt.Sprintf("SET TRANSACTION SNAPSHOT %s;", quoteLiteral(snapshot))
+}
+
+// importRelationships streams the relationships for a job to the writer in
+// chunks, so that memory use doesn't depend on the size of the table. Tables
+// with a primary key are paged through by key, and progress is saved after
+// each chunk.
+func (i *PostgresImporter) importRelationships(ctx context.Context, tx pgx.Tx, j job) error {
+	progress := i.loadProgress(j.key)
+	if progress.Done {
+		log.Info().Str("table", j.table).Str("relation", j.rm.RelationLabel()).Str("range", j.rangeString()).Msg("already imported, skipping")
+		return nil
+	}
+	log.Info().Str("table", j.table).Str("relation", j.rm.RelationLabel()).Str("range", j.rangeString()).Msg("writing relationships")
+
+	if len(j.pks) == 0 {
+		if len(progress.LastKey) > 0 {
+			log.Warn().Str("table", j.table).Str("relation", j.rm.RelationLabel()).Msg("table has no primary key, importing from the start")
+		}
+		if err := i.importAll(ctx, tx, j); err != nil {
+			return err
+		}
+		return i.saveProgress(ctx, j, checkpoint.MappingProgress{Done: true})
+	}
+
+	after := j.from
+	if len(progress.LastKey) > 0 {
+		log.Info().Str("table", j.table).Str("relation", j.rm.RelationLabel()).Strs("after", progress.LastKey).Msg("resuming table import")
+		after = progress.LastKey
+	}
+	written := 0
+	for {
+		rels, lastKey, scanned, err := scanPage(ctx, tx, j.table, j.rm, j.pks, after, j.to)
+		if err != nil {
+			return err
+		}
+		if len(rels) > 0 {
+			if err := i.writer.Write(ctx, touches(rels)); err != nil {
+				return err
+			}
+			i.record(j, 0, len(rels))
+			written += len(rels)
+			log.Debug().Str("table", j.table).Str("relation", j.rm.RelationLabel()).Int("written", written).Msg("wrote chunk")
+		}
+		if scanned > 0 {
+			i.record(j, scanned, 0)
+			after = lastKey
+		}
+		if scanned < chunkSize {
+			break
+		}
+		if err := i.saveProgress(ctx, j, checkpoint.MappingProgress{LastKey: after}); err != nil {
+			return err
+		}
+	}
+	return i.saveProgress(ctx, j, checkpoint.MappingProgress{Done: true})
+}
+
+// importAll streams every relationship for a RowMapping to the writer in
+// chunks, reading them with a cursor
+func (i *PostgresImporter) importAll(ctx context.Context, tx pgx.Tx, j job) error {
+	table, rm := j.table, j.rm
+	chunk := make([]*v1.Relationship, 0, chunkSize)
+	written := 0
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := i.writer.Write(ctx, touches(chunk)); err != nil {
+			return err
+		}
+		i.record(j, 0, len(chunk))
+		written += len(chunk)
+		log.Debug().Str("table", table).Str("relation", rm.RelationLabel()).Int("written", written).Msg("wrote chunk")
+		chunk = make([]*v1.Relationship, 0, chunkSize)
+		return nil
+	}
+	scanned, err := scanRelationships(ctx, tx, table, rm, func(rel *v1.Relationship) error {
+		chunk = append(chunk, rel)
+		if len(chunk) < chunkSize {
+			return nil
+		}
+		return flush()
+	})
+	i.record(j, scanned, 0)
 	if err != nil {
 		return err
 	}
-	return i.writer.Write(ctx, relupdates)
+	return flush()
 }
 
-func (i *PostgresImporter) relationshipsFor(ctx context.Context, table string, rm config.RowMapping) ([]*v1.RelationshipUpdate, error) {
-	relupdates := make([]*v1.RelationshipUpdate, 0)
-	rcols := make([]string, 0)
-	scols := make([]string, 0)
-	for _, r := range rm.ResourceIDCols {
-		rcols = append(rcols, r+"::text")
+func (i *PostgresImporter) loadProgress(key string) checkpoint.MappingProgress {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.progress[key]
+}
+
+// saveProgress records the progress of a job. The end of the job's key
+// range is recorded too, so that a resumed import splits the table the same
+// way.
+func (i *PostgresImporter) saveProgress(ctx context.Context, j job, progress checkpoint.MappingProgress) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	progress.RangeEnd = j.to
+	i.progress[j.key] = progress
+	if i.store == nil {
+		return nil
+	}
+	return i.store.Save(ctx, i.progress)
+}
+
+func touches(rels []*v1.Relationship) []*v1.RelationshipUpdate {
+	updates := make([]*v1.RelationshipUpdate, 0, len(rels))
+	for _, rel := range rels {
+		updates = append(updates, &v1.RelationshipUpdate{
+			Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+			Relationship: rel,
+		})
 	}
-	for _, s := range rm.SubjectIDCols {
-		scols = append(scols, s+"::text")
+	return updates
+}
+
+// scanPage reads up to chunkSize rows of table, ordered by the primary key
+// columns pks, that come after the key after (or from the start, if after is
+// empty) and up to and including the key to (or to the end, if to is
+// empty). It returns their relationships, the key of the last row and the
+// number of rows read.
+func scanPage(ctx context.Context, tx pgx.Tx, table string, rm config.RowMapping, pks []string, after, to []string) ([]*v1.Relationship, []string, int, error) {
+	keyCols := make([]string, 0, len(pks))
+	for _, pk := range pks {
+		keyCols = append(keyCols, pk+"::text")
 	}
-	query := fmt.Sprintf("SELECT CONCAT_WS('_', %s), CONCAT_WS('_', %s) FROM %s;", strings.Join(rcols, ","), strings.Join(scols, ","), table)
-	rows, err := i.conn.Query(ctx, query)
+	conds, err := mappingConds(rm)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
+	}
+	args := []interface{}{pgx.QuerySimpleProtocol(true)}
+	// keys are compared as untyped literals, so that postgres converts them
+	// to the types of the key columns
+	keyCond := func(op string, key []string) error {
+		if len(key) != len(pks) {
+			return fmt.Errorf("can't compare %s key %v with primary key %v", table, key, pks)
+		}
+		params := make([]string, 0, len(key))
+		for _, v := range key {
+			args = append(args, v)
+			params = append(params, fmt.Sprintf("$%d", len(args)-1))
+		}
+		conds = append(conds, fmt.Sprintf("(%s) %s (%s)", strings.Join(pks, ","), op, strings.Join(params, ",")))
+		return nil
+	}
+	if len(after) > 0 {
+		if err := keyCond(">", after); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	if len(to) > 0 {
+		if err := keyCond("<=", to); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	query := fmt.Sprintf("SELECT %s, %s FROM %s%s ORDER BY %s LIMIT %d;", strings.Join(keyCols, ","), relationshipCols(rm), table, whereClause(conds), strings.Join(pks, ","), chunkSize)
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, nil, 0, err
 	}
 	defer rows.Close()
 
+	rels := make([]*v1.Relationship, 0, chunkSize)
+	lastKey := make([]string, len(pks))
+	scanned := 0
 	for rows.Next() {
-		var resid, subid string
-		if err := rows.Scan(&resid, &subid); err != nil {
-			return nil, err
+		var row mappedRow
+		dest := make([]interface{}, 0, len(pks)+2)
+		for n := range lastKey {
+			dest = append(dest, &lastKey[n])
+		}
+		dest = append(dest, row.dest(rm)...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, 0, err
+		}
+		scanned++
+		rel, err := row.relationship(rm)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if rel != nil {
+			rels = append(rels, rel)
 		}
-		rel := &v1.Relationship{
-			Resource: &v1.ObjectReference{
-				ObjectType: rm.ResourceType,
-				ObjectId:   resid,
-			},
-			Relation: rm.Relation,
-			Subject: &v1.SubjectReference{
-				Object: &v1.ObjectReference{
-					ObjectType: rm.SubjectType,
-					ObjectId:   subid,
-				},
-			},
-		}
-		relupdates = append(relupdates, &v1.RelationshipUpdate{
-			Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
-			Relationship: rel,
-		})
 	}
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return nil, nil, 0, err
+	}
+	metrics.ImportRowsScanned.WithLabelValues(table).Add(float64(scanned))
+	return rels, lastKey, scanned, nil
+}
+
+// ScanRelationships reads the rows of table and calls fn with the
+// relationship that the RowMapping generates for each of them. It stops at
+// the first error returned by fn.
+// Rows are fetched from a server-side cursor, chunkSize rows at a time, so
+// tx must be a transaction that is not used for anything else until
+// ScanRelationships returns.
+func ScanRelationships(ctx context.Context, tx pgx.Tx, table string, rm config.RowMapping, fn func(*v1.Relationship) error) error {
+	_, err := scanRelationships(ctx, tx, table, rm, fn)
+	return err
+}
+
+// scanRelationships is ScanRelationships, and returns the number of rows
+// that were read
+func scanRelationships(ctx context.Context, tx pgx.Tx, table string, rm config.RowMapping, fn func(*v1.Relationship) error) (int, error) {
+	conds, err := mappingConds(rm)
+	if err != nil {
+		return 0, err
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s%s", relationshipCols(rm), table, whereClause(conds))
+	if _, err := tx.Exec(ctx, fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s;", cursorName, query)); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	rels := make([]*v1.Relationship, 0, chunkSize)
+	for {
+		rels = rels[:0]
+		rows, err := tx.Query(ctx, fmt.Sprintf("FETCH FORWARD %d FROM %s;", chunkSize, cursorName))
+		if err != nil {
+			return total, err
+		}
+		scanned := 0
+		for rows.Next() {
+			var row mappedRow
+			if err := rows.Scan(row.dest(rm)...); err != nil {
+				rows.Close()
+				return total, err
+			}
+			scanned++
+			rel, err := row.relationship(rm)
+			if err != nil {
+				rows.Close()
+				return total, err
+			}
+			if rel != nil {
+				rels = append(rels, rel)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		total += scanned
+		metrics.ImportRowsScanned.WithLabelValues(table).Add(float64(scanned))
+
+		for _, rel := range rels {
+			if err := fn(rel); err != nil {
+				return total, err
+			}
+		}
+		if scanned < chunkSize {
+			break
+		}
 	}
 
-	return relupdates, nil
+	_, err = tx.Exec(ctx, fmt.Sprintf("CLOSE %s;", cursorName))
+	return total, err
 }
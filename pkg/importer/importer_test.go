@@ -0,0 +1,19 @@
+package importer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetSnapshot(t *testing.T) {
+	require.Equal(t, "SET TRANSACTION SNAPSHOT '00000003-0000001B-1';", setSnapshot("00000003-0000001B-1"))
+	require.Equal(t, "SET TRANSACTION SNAPSHOT 'a''b';", setSnapshot("a'b"))
+}
+
+func TestWithSnapshot(t *testing.T) {
+	i := NewPostgresImporter(nil, nil, nil)
+	require.Empty(t, i.snapshot)
+	i = NewPostgresImporter(nil, nil, nil, WithSnapshot("00000003-0000001B-1"))
+	require.Equal(t, "00000003-0000001B-1", i.snapshot)
+}
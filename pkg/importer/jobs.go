@@ -0,0 +1,275 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+
+	"github.com/authzed/connector-postgresql/pkg/checkpoint"
+	"github.com/authzed/connector-postgresql/pkg/config"
+)
+
+// job is a table and RowMapping to import, optionally limited to a range of
+// primary keys
+type job struct {
+	table string
+	rm    config.RowMapping
+	pks   []string
+	// key identifies the job in the import progress
+	key string
+	// mapping identifies the table and RowMapping, for all ranges
+	mapping string
+	// from and to limit the job to the primary keys after from and up to and
+	// including to; either may be empty
+	from, to []string
+	// part is the number of the range, counting from 1, out of parts ranges
+	part, parts int
+}
+
+func (j job) rangeString() string {
+	if j.parts <= 1 {
+		return "all"
+	}
+	return fmt.Sprintf("%d/%d", j.part, j.parts)
+}
+
+// progressKey identifies a table and RowMapping in the import progress. A
+// table can have several RowMappings that generate the same types of
+// relationships, so they are told apart by their position in the table's
+// mapping.
+func progressKey(table string, n int, rm config.RowMapping) string {
+	return fmt.Sprintf("%s:%d:%s", table, n, rm)
+}
+
+// jobs returns a job for each table and RowMapping in the config, or, for
+// tables with a primary key, one for each range of keys when splitting
+// tables into ranges
+func (i *PostgresImporter) jobs(ctx context.Context, tx pgx.Tx) ([]job, error) {
+	jobs := make([]job, 0)
+	for _, t := range i.mapping {
+		pks := i.primaryKeys[t.Name]
+		var ranges [][]string
+		for m, rm := range t.Relationships {
+			mapping := progressKey(t.Name, m, rm)
+			split := len(pks) > 0 && i.keyRanges > 1
+			parts, recorded, err := i.recordedRanges(mapping)
+			if err != nil {
+				return nil, err
+			}
+			if recorded {
+				// the ranges of a resumed import can't change, since their
+				// progress is recorded by range
+				if (parts != nil) != split || len(parts) > i.keyRanges {
+					log.Warn().Str("table", t.Name).Str("relation", rm.RelationLabel()).Int("ranges", len(parts)).Int("keyRanges", i.keyRanges).Msg("resuming with the key ranges of the interrupted import, not --import-key-ranges")
+				}
+				split = parts != nil
+			}
+			if !split {
+				jobs = append(jobs, job{table: t.Name, rm: rm, pks: pks, key: mapping, mapping: mapping})
+				continue
+			}
+
+			if !recorded {
+				if ranges == nil {
+					ranges, err = keyRanges(ctx, tx, t.Name, pks, i.keyRanges)
+					if err != nil {
+						return nil, err
+					}
+					log.Info().Str("table", t.Name).Int("ranges", len(ranges)).Msg("split table into key ranges")
+				}
+				parts = ranges
+			}
+			var from []string
+			for n, to := range parts {
+				j := job{
+					table:   t.Name,
+					rm:      rm,
+					pks:     pks,
+					key:     rangeKey(mapping, n+1, len(parts)),
+					mapping: mapping,
+					from:    from,
+					to:      to,
+					part:    n + 1,
+					parts:   len(parts),
+				}
+				jobs = append(jobs, j)
+				from = to
+
+				// record every range up front, so that a resumed import
+				// splits the table the same way, even if some ranges
+				// were never started
+				if !recorded {
+					if err := i.saveProgress(ctx, j, checkpoint.MappingProgress{}); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// rangeKey identifies a range of keys of a table and RowMapping in the
+// import progress
+func rangeKey(mapping string, part, parts int) string {
+	return fmt.Sprintf("%s[%d/%d]", mapping, part, parts)
+}
+
+// recordedRanges returns how an earlier import split a mapping into key
+// ranges: the ends of the ranges, or nil if it wasn't split. It returns false
+// if the mapping has no recorded progress, and an error if only some of its
+// ranges are recorded.
+func (i *PostgresImporter) recordedRanges(mapping string) ([][]string, bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.progress[mapping]; ok {
+		return nil, true, nil
+	}
+	parts := 0
+	for key := range i.progress {
+		if !strings.HasPrefix(key, mapping+"[") {
+			continue
+		}
+		var part, n int
+		if _, err := fmt.Sscanf(strings.TrimPrefix(key, mapping), "[%d/%d]", &part, &n); err != nil || n < 1 {
+			return nil, false, fmt.Errorf("invalid key range %q in import progress", key)
+		}
+		if parts != 0 && n != parts {
+			return nil, false, fmt.Errorf("import progress for %s has ranges of different splits", mapping)
+		}
+		parts = n
+	}
+	if parts == 0 {
+		return nil, false, nil
+	}
+	ends := make([][]string, 0, parts)
+	for part := 1; part <= parts; part++ {
+		progress, ok := i.progress[rangeKey(mapping, part, parts)]
+		if !ok {
+			return nil, false, fmt.Errorf("import progress for %s is missing key range %d/%d, start over without --resume", mapping, part, parts)
+		}
+		ends = append(ends, progress.RangeEnd)
+	}
+	return ends, true, nil
+}
+
+// keyRanges splits the rows of table into up to n ranges of primary keys
+// pks with about the same number of rows, and returns the last key of each
+// range. The last range is returned as an empty key, so that it includes
+// everything after the range before it.
+// This reads the primary key index of the whole table once.
+func keyRanges(ctx context.Context, tx pgx.Tx, table string, pks []string, n int) ([][]string, error) {
+	keyCols := make([]string, 0, len(pks))
+	desc := make([]string, 0, len(pks))
+	for _, pk := range pks {
+		keyCols = append(keyCols, pk+"::text")
+		desc = append(desc, pk+" DESC")
+	}
+	query := fmt.Sprintf(
+		"SELECT DISTINCT ON (bucket) %s FROM (SELECT %s, ntile(%d) OVER (ORDER BY %s) AS bucket FROM %s) b ORDER BY bucket, %s;",
+		strings.Join(keyCols, ","), strings.Join(pks, ","), n, strings.Join(pks, ","), table, strings.Join(desc, ","),
+	)
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ends := make([][]string, 0, n)
+	for rows.Next() {
+		end := make([]string, len(pks))
+		dest := make([]interface{}, 0, len(pks))
+		for k := range end {
+			dest = append(dest, &end[k])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		ends = append(ends, end)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ends) == 0 {
+		return [][]string{nil}, nil
+	}
+	ends[len(ends)-1] = nil
+	return ends, nil
+}
+
+// runWorkers imports jobs with up to i.workers jobs at a time, each in its
+// own transaction reading from snapshot. It returns the first error, and
+// stops the other jobs when there is one.
+func (i *PostgresImporter) runWorkers(ctx context.Context, snapshot string, jobs []job) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		once     sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	queue := make(chan job)
+	for w := 0; w < i.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				if err := i.runJob(ctx, snapshot, j); err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("importing %s (range %s): %w", j.mapping, j.rangeString(), err)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+send:
+	for _, j := range jobs {
+		select {
+		case queue <- j:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+func (i *PostgresImporter) runJob(ctx context.Context, snapshot string, j job) error {
+	tx, err := i.begin(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	return i.importRelationships(ctx, tx, j)
+}
+
+// record counts rows read and relationships written for a job
+func (i *PostgresImporter) record(j job, rows, rels int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.scanned[j.table] += rows
+	i.written[j.table] += rels
+}
+
+// logSummary logs the number of rows read and relationships written for
+// each table. Each mapping reads the rows it needs separately, so rows are
+// counted once for each mapping that read them.
+func (i *PostgresImporter) logSummary() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, t := range i.mapping {
+		log.Info().Str("table", t.Name).Int("rowsRead", i.scanned[t.Name]).Int("relationships", i.written[t.Name]).Int("mappings", len(t.Relationships)).Msg("imported table")
+	}
+}
@@ -0,0 +1,183 @@
+package importer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/authzed/connector-postgresql/pkg/checkpoint"
+	"github.com/authzed/connector-postgresql/pkg/config"
+)
+
+func TestResumedJobs(t *testing.T) {
+	rm := config.RowMapping{ResourceType: "contact", Relation: "owner", SubjectType: "user", ResourceIDCols: []string{"id"}, SubjectIDCols: []string{"user_id"}}
+	mapping := progressKey("contacts", 0, rm)
+	tests := []struct {
+		name      string
+		keyRanges int
+		progress  checkpoint.ImportProgress
+		parts     []string
+		err       string
+	}{
+		{
+			name:      "unsplit, now splitting",
+			keyRanges: 4,
+			progress:  checkpoint.ImportProgress{mapping: {LastKey: []string{"10"}}},
+			parts:     []string{"all"},
+		},
+		{
+			name:      "more ranges than now",
+			keyRanges: 2,
+			progress: checkpoint.ImportProgress{
+				rangeKey(mapping, 1, 3): {RangeEnd: []string{"10"}, Done: true},
+				rangeKey(mapping, 2, 3): {RangeEnd: []string{"20"}},
+				rangeKey(mapping, 3, 3): {},
+			},
+			parts: []string{"1/3", "2/3", "3/3"},
+		},
+		{
+			name:      "split, now not splitting",
+			keyRanges: 1,
+			progress: checkpoint.ImportProgress{
+				rangeKey(mapping, 1, 2): {RangeEnd: []string{"10"}},
+				rangeKey(mapping, 2, 2): {},
+			},
+			parts: []string{"1/2", "2/2"},
+		},
+		{
+			name:      "missing range",
+			keyRanges: 2,
+			progress: checkpoint.ImportProgress{
+				rangeKey(mapping, 1, 2): {RangeEnd: []string{"10"}},
+			},
+			err: "import progress for " + mapping + " is missing key range 2/2, start over without --resume",
+		},
+		{
+			name:      "different splits",
+			keyRanges: 2,
+			progress: checkpoint.ImportProgress{
+				rangeKey(mapping, 1, 2): {RangeEnd: []string{"10"}},
+				rangeKey(mapping, 1, 3): {RangeEnd: []string{"5"}},
+			},
+			err: "import progress for " + mapping + " has ranges of different splits",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := &PostgresImporter{
+				mapping:     []config.TableMapping{{Name: "contacts", Relationships: []config.RowMapping{rm}}},
+				primaryKeys: map[string][]string{"contacts": {"id"}},
+				keyRanges:   tt.keyRanges,
+				progress:    tt.progress,
+			}
+			jobs, err := i.jobs(context.Background(), nil)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			parts := make([]string, 0, len(jobs))
+			for n, j := range jobs {
+				parts = append(parts, j.rangeString())
+				if n > 0 {
+					require.Equal(t, jobs[n-1].to, j.from)
+				}
+				require.Equal(t, tt.progress[j.key].RangeEnd, j.to)
+			}
+			require.Equal(t, tt.parts, parts)
+		})
+	}
+}
+
+type memoryStore struct {
+	saved []checkpoint.ImportProgress
+}
+
+func (s *memoryStore) Load(ctx context.Context) (checkpoint.ImportProgress, error) {
+	if len(s.saved) == 0 {
+		return make(checkpoint.ImportProgress, 0), nil
+	}
+	return s.saved[len(s.saved)-1], nil
+}
+
+func (s *memoryStore) Save(ctx context.Context, progress checkpoint.ImportProgress) error {
+	copied := make(checkpoint.ImportProgress, len(progress))
+	for k, v := range progress {
+		copied[k] = v
+	}
+	s.saved = append(s.saved, copied)
+	return nil
+}
+
+func TestSaveProgress(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{}
+	i := NewPostgresImporter(nil, nil, nil, WithProgress(store, true))
+	j := job{table: "contacts", key: "contacts:contact#owner@user[1/2]", to: []string{"10"}}
+
+	require.Equal(t, checkpoint.MappingProgress{}, i.loadProgress(j.key))
+	require.NoError(t, i.saveProgress(ctx, j, checkpoint.MappingProgress{LastKey: []string{"3"}}))
+	require.NoError(t, i.saveProgress(ctx, j, checkpoint.MappingProgress{Done: true}))
+
+	// the end of the range is recorded with the progress
+	require.Equal(t, checkpoint.MappingProgress{Done: true, RangeEnd: []string{"10"}}, i.loadProgress(j.key))
+	require.Equal(t, []checkpoint.ImportProgress{
+		{j.key: {LastKey: []string{"3"}, RangeEnd: []string{"10"}}},
+		{j.key: {Done: true, RangeEnd: []string{"10"}}},
+	}, store.saved)
+
+	// completed jobs are skipped without reading the table
+	require.NoError(t, i.importRelationships(ctx, nil, j))
+
+	// without a store, progress is only kept in memory
+	i = NewPostgresImporter(nil, nil, nil)
+	require.NoError(t, i.saveProgress(ctx, j, checkpoint.MappingProgress{Done: true}))
+	require.True(t, i.loadProgress(j.key).Done)
+}
+
+func TestSameTypedMappings(t *testing.T) {
+	ctx := context.Background()
+	owner := config.RowMapping{ResourceType: "document", Relation: "viewer", SubjectType: "user", ResourceIDCols: []string{"id"}, SubjectIDCols: []string{"owner_id"}}
+	public := config.RowMapping{
+		ResourceType:   "document",
+		Relation:       "viewer",
+		SubjectType:    "user",
+		ResourceIDCols: []string{"id"},
+		WildcardWhen:   &config.ColumnPredicate{Col: "is_public", Values: []string{"true"}},
+	}
+	i := NewPostgresImporter(nil, nil, []config.TableMapping{{Name: "documents", Relationships: []config.RowMapping{owner, public}}})
+	jobs, err := i.jobs(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	require.NotEqual(t, jobs[0].key, jobs[1].key)
+
+	// completing one mapping doesn't complete the other
+	require.NoError(t, i.saveProgress(ctx, jobs[0], checkpoint.MappingProgress{Done: true}))
+	require.True(t, i.loadProgress(jobs[0].key).Done)
+	require.False(t, i.loadProgress(jobs[1].key).Done)
+}
+
+func TestSameTypedMappingRanges(t *testing.T) {
+	owner := config.RowMapping{ResourceType: "document", Relation: "viewer", SubjectType: "user", ResourceIDCols: []string{"id"}, SubjectIDCols: []string{"owner_id"}}
+	editor := config.RowMapping{ResourceType: "document", Relation: "viewer", SubjectType: "user", ResourceIDCols: []string{"id"}, SubjectIDCols: []string{"editor_id"}}
+	first := progressKey("documents", 0, owner)
+	i := &PostgresImporter{
+		mapping:     []config.TableMapping{{Name: "documents", Relationships: []config.RowMapping{owner, editor}}},
+		primaryKeys: map[string][]string{"documents": {"id"}},
+		keyRanges:   1,
+		progress: checkpoint.ImportProgress{
+			rangeKey(first, 1, 2): {RangeEnd: []string{"10"}, Done: true},
+			rangeKey(first, 2, 2): {},
+		},
+	}
+	jobs, err := i.jobs(context.Background(), nil)
+	require.NoError(t, err)
+	parts := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		parts = append(parts, j.rangeString())
+	}
+	// only the first mapping was split by the interrupted import
+	require.Equal(t, []string{"1/2", "2/2", "all"}, parts)
+	require.False(t, i.loadProgress(jobs[2].key).Done)
+}
@@ -0,0 +1,208 @@
+package importer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/connector-postgresql/pkg/config"
+)
+
+// mappedRow holds the values that a RowMapping reads from a row
+type mappedRow struct {
+	resourceID      string
+	subjectID       string
+	subjectRelation *string
+	relation        *string
+	resourceType    *string
+	subjectType     *string
+}
+
+// mappedCols returns the expressions that select the values of a mappedRow
+// for the RowMapping, in the order that dest expects them
+func mappedCols(rm config.RowMapping) []string {
+	rcols := make([]string, 0)
+	scols := make([]string, 0)
+	for _, r := range rm.ResourceIDCols {
+		rcols = append(rcols, r+"::text")
+	}
+	for _, s := range rm.SubjectIDCols {
+		scols = append(scols, s+"::text")
+	}
+	cols := []string{fmt.Sprintf("CONCAT_WS('_', %s)", strings.Join(rcols, ","))}
+	if rm.WildcardWhen == nil {
+		cols = append(cols, fmt.Sprintf("CONCAT_WS('_', %s)", strings.Join(scols, ",")))
+	}
+	if rm.SubjectRelationCol != "" {
+		cols = append(cols, rm.SubjectRelationCol+"::text")
+	}
+	if rm.RelationFromCol != "" {
+		cols = append(cols, rm.RelationFromCol+"::text")
+	}
+	if rm.ResourceTypeFromCol != "" {
+		cols = append(cols, rm.ResourceTypeFromCol+"::text")
+	}
+	if rm.SubjectTypeFromCol != "" {
+		cols = append(cols, rm.SubjectTypeFromCol+"::text")
+	}
+	return cols
+}
+
+// relationshipCols returns the columns that select the values the
+// RowMapping's relationship is built from
+func relationshipCols(rm config.RowMapping) string {
+	return strings.Join(mappedCols(rm), ", ")
+}
+
+// mappingConds returns the conditions that rows must meet to generate a
+// relationship for the RowMapping
+func mappingConds(rm config.RowMapping) ([]string, error) {
+	conds := make([]string, 0)
+	// CONCAT_WS skips nulls, so rows with a null id would otherwise generate
+	// an empty or partial id; the follower skips them too
+	idCols := rm.ResourceIDCols
+	if rm.WildcardWhen == nil {
+		idCols = append(append([]string{}, rm.ResourceIDCols...), rm.SubjectIDCols...)
+	}
+	for _, col := range idCols {
+		conds = append(conds, col+" IS NOT NULL")
+	}
+	if rm.WildcardWhen != nil {
+		conds = append(conds, predicateCond(*rm.WildcardWhen))
+	}
+	// rows with unmapped types don't generate a relationship
+	if rm.ResourceTypeFromCol != "" {
+		conds = append(conds, predicateCond(typeColPredicate(rm.ResourceTypeFromCol, rm.ResourceTypeMap)))
+	}
+	if rm.SubjectTypeFromCol != "" {
+		conds = append(conds, predicateCond(typeColPredicate(rm.SubjectTypeFromCol, rm.SubjectTypeMap)))
+	}
+	f, err := rm.ParseFilter()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter for %s: %w", rm, err)
+	}
+	if f != nil {
+		conds = append(conds, f.SQL())
+	}
+	return conds, nil
+}
+
+// predicateCond is the SQL condition for a ColumnPredicate. The values are
+// untyped literals, so postgres compares them as the column's type.
+func predicateCond(p config.ColumnPredicate) string {
+	values := make([]string, 0, len(p.Values))
+	for _, v := range p.Values {
+		values = append(values, quoteLiteral(v))
+	}
+	return fmt.Sprintf("%s IN (%s)", p.Col, strings.Join(values, ","))
+}
+
+// typeColPredicate holds for rows where a type column has one of the values
+// in its type map
+func typeColPredicate(col string, typeMap map[string]string) config.ColumnPredicate {
+	values := make([]string, 0, len(typeMap))
+	for v := range typeMap {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return config.ColumnPredicate{Col: col, Values: values}
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// whereClause returns a WHERE clause for conds, or nothing if there are none
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// dest returns the values to scan the columns from mappedCols into
+func (r *mappedRow) dest(rm config.RowMapping) []interface{} {
+	dest := []interface{}{&r.resourceID}
+	if rm.WildcardWhen == nil {
+		dest = append(dest, &r.subjectID)
+	}
+	if rm.SubjectRelationCol != "" {
+		dest = append(dest, &r.subjectRelation)
+	}
+	if rm.RelationFromCol != "" {
+		dest = append(dest, &r.relation)
+	}
+	if rm.ResourceTypeFromCol != "" {
+		dest = append(dest, &r.resourceType)
+	}
+	if rm.SubjectTypeFromCol != "" {
+		dest = append(dest, &r.subjectType)
+	}
+	return dest
+}
+
+// relationship builds the relationship that the RowMapping generates for the
+// row, or returns nil if the row doesn't describe one
+func (r *mappedRow) relationship(rm config.RowMapping) (*v1.Relationship, error) {
+	relation := rm.Relation
+	if rm.RelationFromCol != "" {
+		if r.relation == nil {
+			return nil, nil
+		}
+		var ok bool
+		var err error
+		relation, ok, err = config.ResolveRelation(*r.relation, rm.RelationMap, rm.UnknownRelation)
+		if err != nil {
+			return nil, fmt.Errorf("%s, resource %s: %w", rm, r.resourceID, err)
+		}
+		if !ok {
+			return nil, nil
+		}
+	}
+	resourceType, ok := mappedType(rm.ResourceType, r.resourceType, rm.ResourceTypeMap)
+	if !ok {
+		return nil, nil
+	}
+	subjectType, ok := mappedType(rm.SubjectType, r.subjectType, rm.SubjectTypeMap)
+	if !ok {
+		return nil, nil
+	}
+	subjectRelation := rm.SubjectRelation
+	if r.subjectRelation != nil {
+		subjectRelation = *r.subjectRelation
+	}
+	subjectID := r.subjectID
+	if rm.WildcardWhen != nil {
+		subjectID = "*"
+	}
+	return &v1.Relationship{
+		Resource: &v1.ObjectReference{
+			ObjectType: resourceType,
+			ObjectId:   r.resourceID,
+		},
+		Relation: relation,
+		Subject: &v1.SubjectReference{
+			Object: &v1.ObjectReference{
+				ObjectType: subjectType,
+				ObjectId:   subjectID,
+			},
+			OptionalRelation: subjectRelation,
+		},
+	}, nil
+}
+
+// mappedType returns the static type if there is one, or else the type that
+// the value of the type column maps to. It returns false if the value is null
+// or not in the map.
+func mappedType(static string, value *string, typeMap map[string]string) (string, bool) {
+	if static != "" {
+		return static, true
+	}
+	if value == nil {
+		return "", false
+	}
+	typ, ok := typeMap[*value]
+	return typ, ok
+}
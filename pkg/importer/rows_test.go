@@ -0,0 +1,70 @@
+package importer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/authzed/connector-postgresql/pkg/config"
+	"github.com/authzed/connector-postgresql/pkg/util"
+)
+
+var ownerMapping = config.RowMapping{
+	ResourceType:   "contact",
+	Relation:       "owner",
+	SubjectType:    "user",
+	ResourceIDCols: []string{"id"},
+	SubjectIDCols:  []string{"org_id", "user_id"},
+}
+
+func TestRelationshipCols(t *testing.T) {
+	require.Equal(t, "CONCAT_WS('_', id::text), CONCAT_WS('_', org_id::text,user_id::text)", relationshipCols(ownerMapping))
+}
+
+func TestWhereClause(t *testing.T) {
+	require.Equal(t, "", whereClause(nil))
+	require.Equal(t, " WHERE a = 1", whereClause([]string{"a = 1"}))
+	require.Equal(t, " WHERE a = 1 AND b IN ('x','y')", whereClause([]string{"a = 1", "b IN ('x','y')"}))
+}
+
+func TestMappingConds(t *testing.T) {
+	// rows with a null id don't generate a relationship
+	conds, err := mappingConds(ownerMapping)
+	require.NoError(t, err)
+	require.Equal(t, []string{"id IS NOT NULL", "org_id IS NOT NULL", "user_id IS NOT NULL"}, conds)
+}
+
+func TestMappedRowRelationship(t *testing.T) {
+	var row mappedRow
+	dest := row.dest(ownerMapping)
+	require.Len(t, dest, len(mappedCols(ownerMapping)))
+	*dest[0].(*string) = "1"
+	*dest[1].(*string) = "acme_2"
+
+	rel, err := row.relationship(ownerMapping)
+	require.NoError(t, err)
+	require.Equal(t, "contact:1#owner@user:acme_2", util.RelString(rel))
+}
+
+func TestWildcardRows(t *testing.T) {
+	rm := config.RowMapping{
+		ResourceType:   "document",
+		Relation:       "viewer",
+		SubjectType:    "user",
+		ResourceIDCols: []string{"id"},
+		WildcardWhen:   &config.ColumnPredicate{Col: "is_public", Values: []string{"true"}},
+	}
+	// the subject id isn't read, only rows matching the predicate are
+	require.Equal(t, "CONCAT_WS('_', id::text)", relationshipCols(rm))
+	conds, err := mappingConds(rm)
+	require.NoError(t, err)
+	require.Equal(t, []string{"id IS NOT NULL", "is_public IN ('true')"}, conds)
+
+	var row mappedRow
+	dest := row.dest(rm)
+	require.Len(t, dest, 1)
+	*dest[0].(*string) = "1"
+	rel, err := row.relationship(rm)
+	require.NoError(t, err)
+	require.Equal(t, "document:1#viewer@user:*", util.RelString(rel))
+}
@@ -0,0 +1,113 @@
+// Package metrics holds the prometheus metrics exported by the connector.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "connector_postgresql"
+
+var (
+	// ImportRowsScanned counts the rows read by the importer, by table
+	ImportRowsScanned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "import",
+		Name:      "rows_scanned_total",
+		Help:      "Number of rows read from postgres by the importer.",
+	}, []string{"table"})
+
+	// RelationshipUpdates counts the relationship updates written to SpiceDB,
+	// by resource type and operation (touch, delete or delete_by_filter)
+	RelationshipUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "spicedb",
+		Name:      "relationship_updates_total",
+		Help:      "Number of relationship updates written to SpiceDB.",
+	}, []string{"resource_type", "operation"})
+
+	// RequestDuration tracks the latency of requests to SpiceDB, by method
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "spicedb",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of requests to SpiceDB.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// RequestErrors counts failed requests to SpiceDB, by method and grpc code
+	RequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "spicedb",
+		Name:      "request_errors_total",
+		Help:      "Number of requests to SpiceDB that failed.",
+	}, []string{"method", "code"})
+
+	// RequestRetries counts requests to SpiceDB that were retried, by method
+	// and the grpc code of the failed attempt
+	RequestRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "spicedb",
+		Name:      "request_retries_total",
+		Help:      "Number of failed requests to SpiceDB that were retried.",
+	}, []string{"method", "code"})
+
+	// DeadLetters counts requests to SpiceDB that were rejected and sent to
+	// the dead letter path instead of being retried, by method
+	DeadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "spicedb",
+		Name:      "dead_letters_total",
+		Help:      "Number of requests to SpiceDB that were rejected and sent to the dead letter path.",
+	}, []string{"method"})
+
+	// CacheQueueDepth is the number of transactions waiting to be applied
+	CacheQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "queue_depth",
+		Help:      "Number of transactions queued or in flight to SpiceDB.",
+	})
+
+	// CacheRequeues counts transactions that failed to apply and were requeued
+	CacheRequeues = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "requeues_total",
+		Help:      "Number of transactions that failed to apply and were requeued.",
+	})
+
+	// LSN is the latest position in the replication log that has been
+	// received, flushed (reported to postgres) and applied to SpiceDB
+	LSN = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "replication",
+		Name:      "lsn",
+		Help:      "Position in the replication log that has been received, flushed (reported to postgres) or applied to SpiceDB.",
+	}, []string{"position"})
+
+	// LagBytes is how far the applied position is behind the end of the
+	// server's WAL
+	LagBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "replication",
+		Name:      "lag_bytes",
+		Help:      "Bytes of WAL on the server that have not been applied to SpiceDB.",
+	})
+
+	// LagSeconds is the time between the commit of the last applied
+	// transaction in postgres and it being applied to SpiceDB
+	LagSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "replication",
+		Name:      "lag_seconds",
+		Help:      "Time between a transaction committing in postgres and being applied to SpiceDB, for the last applied transaction.",
+	})
+)
+
+// Positions in the replication log tracked by the LSN metric
+const (
+	PositionReceived = "received"
+	PositionFlushed  = "flushed"
+	PositionApplied  = "applied"
+)
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// Server serves the prometheus metrics over http on /metrics. Other handlers
+// can be added to serve them from the same listener.
+type Server struct {
+	srv *http.Server
+	mux *http.ServeMux
+}
+
+// NewServer returns a Server that will listen on addr
+func NewServer(addr string) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &Server{
+		srv: &http.Server{Addr: addr, Handler: mux},
+		mux: mux,
+	}
+}
+
+// Handle registers a handler for the pattern, it must be called before Run
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Run serves until ctx is cancelled
+func (s *Server) Run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.srv.Shutdown(shutdownCtx); err != nil {
+			log.Warn().Err(err).Msg("failed to shut down metrics server")
+		}
+	}()
+	log.Info().Str("addr", s.srv.Addr).Msg("serving metrics")
+	if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -60,6 +60,15 @@ type ConfigOptions struct {
 }
 
 func (o *ConfigOptions) Complete(ctx context.Context, replogConfig *pgxpool.Config, streams streams.IO) error {
+	if err := o.load(ctx, replogConfig, streams); err != nil {
+		return err
+	}
+	return o.Config.Validate()
+}
+
+// load reads the config from the mapping file, or generates it from the
+// postgres schema, unless it is already set
+func (o *ConfigOptions) load(ctx context.Context, replogConfig *pgxpool.Config, streams streams.IO) error {
 	if o.Config != nil {
 		log.Debug().Msg("mapping config already set, skipping mapping option validation")
 		o.ConfigPrinter = DiscardConfigPrinter
@@ -93,6 +102,9 @@ func (o *ConfigOptions) Complete(ctx context.Context, replogConfig *pgxpool.Conf
 	if err != nil {
 		return err
 	}
+	if err := schema.SyncPolymorphicRefs(ctx, replogConn); err != nil {
+		return err
+	}
 	o.Config = schema.ToConfig()
 	o.ConfigPrinter = YAMLConfigPrinter(streams.Out)
 	return nil
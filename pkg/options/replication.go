@@ -0,0 +1,100 @@
+package options
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/authzed/connector-postgresql/pkg/checkpoint"
+	"github.com/authzed/connector-postgresql/pkg/follow"
+)
+
+// slot and publication names may only contain lower case letters, numbers,
+// and underscores
+var slotNameRegex = regexp.MustCompile(`^[a-z0-9_]{1,63}$`)
+
+// maxSlotNameLen is the longest name postgres allows for a slot
+const maxSlotNameLen = 63
+
+// ReplicationOptions holds options related to following the replication log
+type ReplicationOptions struct {
+	SlotName            string
+	TemporarySlot       bool
+	CheckpointFile      string
+	MaxTransactionSize  int
+	TruncatePolicy      string
+	RetryWindow         time.Duration
+	ShutdownGracePeriod time.Duration
+	Publication         string
+	PublicationMode     string
+
+	CheckpointStore checkpoint.Store
+}
+
+// Complete configures the checkpoint store for the replication slot.
+// Temporary slots are dropped when the connector exits, so there is nothing
+// to resume and no checkpoints are stored.
+func (o *ReplicationOptions) Complete() error {
+	if o.MaxTransactionSize <= 0 {
+		return fmt.Errorf("max transaction size must be positive")
+	}
+	if o.RetryWindow < 0 {
+		return fmt.Errorf("replication retry window must not be negative")
+	}
+	if o.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("shutdown grace period must not be negative")
+	}
+	if !validTruncatePolicy(o.TruncatePolicy) {
+		return fmt.Errorf("invalid truncate policy %q, must be one of %v", o.TruncatePolicy, follow.TruncatePolicies)
+	}
+	if !slotNameRegex.MatchString(o.Publication) {
+		return fmt.Errorf("invalid publication name %q: only lower case letters, numbers and underscores are allowed", o.Publication)
+	}
+	if !validPublicationMode(o.PublicationMode) {
+		return fmt.Errorf("invalid publication mode %q, must be one of %v", o.PublicationMode, follow.PublicationModes)
+	}
+	if o.CheckpointStore != nil {
+		log.Debug().Msg("checkpoint store already set, skipping replication option validation")
+		return nil
+	}
+	if o.SlotName == "" {
+		return fmt.Errorf("must provide a replication slot name")
+	}
+	if !slotNameRegex.MatchString(o.SlotName) {
+		return fmt.Errorf("invalid replication slot name %q: only lower case letters, numbers and underscores are allowed", o.SlotName)
+	}
+	if o.TemporarySlot {
+		// temporary slots get a random suffix, which must fit too
+		if maxLen := maxSlotNameLen - follow.TemporarySlotSuffixLen; len(o.SlotName) > maxLen {
+			return fmt.Errorf("replication slot name %q is too long for a temporary slot, it can have at most %d characters", o.SlotName, maxLen)
+		}
+		log.Warn().Str("slot", o.SlotName).Msg("temporary replication slots are dropped when the connection to postgres is lost, so the connector exits instead of reconnecting")
+		o.CheckpointStore = checkpoint.DiscardingStore{}
+		return nil
+	}
+	if o.CheckpointFile == "" {
+		return fmt.Errorf("must provide a checkpoint file when using a permanent replication slot")
+	}
+	o.CheckpointStore = checkpoint.NewFileStore(o.CheckpointFile, o.SlotName)
+	return nil
+}
+
+func validTruncatePolicy(policy string) bool {
+	for _, p := range follow.TruncatePolicies {
+		if follow.TruncatePolicy(policy) == p {
+			return true
+		}
+	}
+	return false
+}
+
+func validPublicationMode(mode string) bool {
+	for _, m := range follow.PublicationModes {
+		if follow.PublicationMode(mode) == m {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package options
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/authzed/connector-postgresql/pkg/checkpoint"
+	"github.com/authzed/connector-postgresql/pkg/follow"
+)
+
+func validReplicationOptions() ReplicationOptions {
+	return ReplicationOptions{
+		SlotName:           "spicedb_sync_slot",
+		CheckpointFile:     "connector-postgresql.checkpoint",
+		MaxTransactionSize: 1000,
+		TruncatePolicy:     string(follow.TruncatePolicyApply),
+		Publication:        "spicedb_sync",
+		PublicationMode:    string(follow.PublicationModeCreate),
+	}
+}
+
+func TestReplicationOptionsComplete(t *testing.T) {
+	o := validReplicationOptions()
+	require.NoError(t, o.Complete())
+	require.IsType(t, &checkpoint.FileStore{}, o.CheckpointStore)
+
+	o = validReplicationOptions()
+	o.TemporarySlot = true
+	o.CheckpointFile = ""
+	require.NoError(t, o.Complete())
+	require.Equal(t, checkpoint.DiscardingStore{}, o.CheckpointStore)
+
+	// the longest prefix still makes a valid name with the random suffix
+	o = validReplicationOptions()
+	o.TemporarySlot = true
+	o.SlotName = strings.Repeat("s", 52)
+	require.NoError(t, o.Complete())
+	require.Len(t, follow.NewWalFollower(nil, nil, nil, follow.Options{SlotName: o.SlotName, TemporarySlot: true}).SlotName(), 63)
+
+	tests := []struct {
+		name   string
+		modify func(o *ReplicationOptions)
+		err    string
+	}{
+		{name: "no checkpoint file", modify: func(o *ReplicationOptions) { o.CheckpointFile = "" }, err: "must provide a checkpoint file when using a permanent replication slot"},
+		{name: "invalid slot name", modify: func(o *ReplicationOptions) { o.SlotName = "Slot-1" }, err: `invalid replication slot name "Slot-1": only lower case letters, numbers and underscores are allowed`},
+		{
+			name:   "temporary slot name",
+			modify: func(o *ReplicationOptions) { o.TemporarySlot = true; o.SlotName = strings.Repeat("s", 53) },
+			err:    `replication slot name "` + strings.Repeat("s", 53) + `" is too long for a temporary slot, it can have at most 52 characters`,
+		},
+		{name: "no slot name", modify: func(o *ReplicationOptions) { o.SlotName = "" }, err: "must provide a replication slot name"},
+		{name: "transaction size", modify: func(o *ReplicationOptions) { o.MaxTransactionSize = 0 }, err: "max transaction size must be positive"},
+		{name: "truncate policy", modify: func(o *ReplicationOptions) { o.TruncatePolicy = "ignore" }, err: `invalid truncate policy "ignore", must be one of ` + fmt.Sprint(follow.TruncatePolicies)},
+		{name: "publication mode", modify: func(o *ReplicationOptions) { o.PublicationMode = "replace" }, err: `invalid publication mode "replace", must be one of ` + fmt.Sprint(follow.PublicationModes)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := validReplicationOptions()
+			tt.modify(&o)
+			require.EqualError(t, o.Complete(), tt.err)
+		})
+	}
+}
@@ -13,6 +13,14 @@ SELECT DISTINCT attname,attnum
 FROM  pg_attribute,pg_class 
 WHERE attrelid = pg_class.oid
 AND   pg_class.relname=$1;
+`
+	// querySelectTypeValues is formatted with the (quoted) type column and
+	// table of a polymorphic reference
+	querySelectTypeValues = `
+SELECT DISTINCT %s::text
+FROM   %s
+WHERE  %[1]s IS NOT NULL
+LIMIT  100;
 `
 	querySelectPrimaryKeys = `
 SELECT a.attnum,a.attname 
@@ -21,6 +29,7 @@ JOIN   pg_attribute a ON a.attrelid = i.indrelid
                      AND a.attnum   = ANY(i.indkey)
 WHERE  i.indrelid = $1::regclass
 AND    i.indisprimary
+ORDER BY array_position(i.indkey::int2[], a.attnum)
 `
 	querySelectForeignKeys = `
 SELECT   string_agg(kcu.column_name, ',') AS fk_columns,
@@ -1,6 +1,10 @@
 package pgschema
 
 import (
+	"sort"
+	"strings"
+	"unicode"
+
 	"github.com/authzed/connector-postgresql/pkg/config"
 	"github.com/jackc/pglogrepl"
 )
@@ -35,6 +39,11 @@ func (s *Schema) ToTableMapping() []config.TableMapping {
 				SubjectIDCols:  fk.cols,
 			})
 		}
+		for _, ref := range t.PolymorphicRefs {
+			if rm, ok := s.polymorphicMapping(t, ref); ok {
+				relationshipConfig = append(relationshipConfig, rm)
+			}
+		}
 		mapping = append(mapping, config.TableMapping{
 			Name:          t.Name,
 			Relationships: relationshipConfig,
@@ -43,68 +52,110 @@ func (s *Schema) ToTableMapping() []config.TableMapping {
 	return mapping
 }
 
-// ToZedSchema generates an (example) zed schema for the postgres schema
+// polymorphicMapping suggests a RowMapping for a polymorphic reference, whose
+// subject type comes from the type column. Values of the type column are
+// mapped to the tables they name, e.g. Post or post to posts, and the
+// reference is skipped if none of them name a table.
+func (s *Schema) polymorphicMapping(t *Table, ref PolymorphicRef) (config.RowMapping, bool) {
+	tables := make(map[string]string, len(s.Tables))
+	for _, other := range s.Tables {
+		tables[normalizeTypeName(other.Name)] = other.Name
+	}
+	typeMap := make(map[string]string, len(ref.values))
+	for _, v := range ref.values {
+		if table, ok := tables[normalizeTypeName(v)]; ok {
+			typeMap[v] = table
+		}
+	}
+	if len(typeMap) == 0 || len(t.PrimaryKeys.cols) == 0 {
+		return config.RowMapping{}, false
+	}
+	return config.RowMapping{
+		ResourceType:       t.Name,
+		Relation:           ref.name,
+		ResourceIDCols:     t.PrimaryKeys.cols,
+		SubjectIDCols:      []string{ref.idCol},
+		SubjectTypeFromCol: ref.typeCol,
+		SubjectTypeMap:     typeMap,
+	}, true
+}
+
+// normalizeTypeName reduces a table name or a value of a type column to a
+// form in which the singular and plural and the different casings of a name
+// match, e.g. Post, post and posts, or BlogPost and blog_posts
+func normalizeTypeName(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			b.WriteRune(c)
+		}
+	}
+	n := b.String()
+	switch {
+	case strings.HasSuffix(n, "ies"):
+		return strings.TrimSuffix(n, "ies") + "y"
+	case strings.HasSuffix(n, "ses"), strings.HasSuffix(n, "xes"):
+		return strings.TrimSuffix(n, "es")
+	case strings.HasSuffix(n, "s") && !strings.HasSuffix(n, "ss"):
+		return strings.TrimSuffix(n, "s")
+	}
+	return n
+}
+
+// ToZedSchema generates an (example) zed schema for the postgres schema,
+// with a definition for each table and the relations of the mapping from
+// ToTableMapping
 func (s *Schema) ToZedSchema() (zedSchema string) {
+	relations := make(map[string][]config.RowMapping, len(s.Tables))
+	for _, tm := range s.ToTableMapping() {
+		for _, rm := range tm.Relationships {
+			for _, resourceType := range rm.ResourceTypes() {
+				relations[resourceType] = append(relations[resourceType], rm)
+			}
+		}
+	}
 	for _, t := range s.Tables {
 		zedSchema += "\n"
 		zedSchema += "definition " + t.Name
-		if len(t.ForeignKeys) == 0 {
+		if len(relations[t.Name]) == 0 {
 			zedSchema += " {}\n"
 			continue
 		}
 		zedSchema += " {\n"
-		for _, fk := range t.ForeignKeys {
-			zedSchema += "    relation " + fk.name + ": " + fk.primaryTable + "\n"
+		for _, rm := range relations[t.Name] {
+			for _, relation := range zedRelations(rm) {
+				zedSchema += "    relation " + relation + ": " + zedSubjectType(rm) + "\n"
+			}
 		}
 		zedSchema += "}\n"
 	}
 	return
 }
 
-// InternalMapping converts a TableMapping config to an InternalTableMapping by
-// using the information on the Schema.
-func (s *Schema) InternalMapping(external []config.TableMapping) []config.InternalTableMapping {
-	tmap := make(map[string]*Table, 0)
-	for _, t := range s.Tables {
-		tmap[t.Name] = t
+// zedRelations are the relations of a RowMapping in a zed definition. For
+// relations that come from a column, these are the values of its relation
+// map, since others can't be known in advance.
+func zedRelations(rm config.RowMapping) []string {
+	if rm.RelationFromCol == "" {
+		return []string{rm.Relation}
 	}
-	mapping := make([]config.InternalTableMapping, 0, len(external))
-	for _, extMap := range external {
-		internalRelMap := make([]config.InternalRowMapping, 0, len(extMap.Relationships))
-		for _, rm := range extMap.Relationships {
-			resids := make([]int, 0)
-			subids := make([]int, 0)
-			// TODO: better
-			for _, colname := range rm.ResourceIDCols {
-				for _, col := range tmap[extMap.Name].Cols {
-					if col.name == colname {
-						resids = append(resids, col.id)
-						break
-					}
-				}
-			}
-			for _, colname := range rm.SubjectIDCols {
-				for _, col := range tmap[extMap.Name].Cols {
-					if col.name == colname {
-						subids = append(subids, col.id)
-						break
-					}
-				}
-			}
-			internalRelMap = append(internalRelMap, config.InternalRowMapping{
-				ResourceType:   rm.ResourceType,
-				SubjectType:    rm.SubjectType,
-				Relation:       rm.Relation,
-				ResourceIDCols: resids,
-				SubjectIDCols:  subids,
-			})
+	seen := make(map[string]struct{}, len(rm.RelationMap))
+	relations := make([]string, 0, len(rm.RelationMap))
+	for _, relation := range rm.RelationMap {
+		if _, ok := seen[relation]; ok {
+			continue
 		}
-		mapping = append(mapping, config.InternalTableMapping{
-			TableID:              tmap[extMap.Name].ID,
-			RelationshipsByColID: internalRelMap,
-		})
+		seen[relation] = struct{}{}
+		relations = append(relations, relation)
 	}
-	return mapping
+	sort.Strings(relations)
+	return relations
+}
+
+// zedSubjectType is the type of a RowMapping's subjects in a zed relation,
+// with each of the types if the subject type comes from a column
+func zedSubjectType(rm config.RowMapping) string {
+	return strings.Join(rm.SubjectTypes(), " | ")
 }
 
 // Table is associated with a set of PrimaryKeys and a set of ForeignKeys
@@ -115,6 +166,9 @@ type Table struct {
 	PrimaryKeys PrimaryKey
 	ForeignKeys []ForeignKey
 	Cols        []Col
+	// PolymorphicRefs are the table's pairs of <name>_type and <name>_id
+	// columns that aren't covered by a foreign key, see SyncPolymorphicRefs
+	PolymorphicRefs []PolymorphicRef
 }
 
 // PrimaryKey is the name of a primary key field in a table
@@ -123,6 +177,20 @@ type PrimaryKey struct {
 	cols   []string
 }
 
+// Cols returns the names of the primary key columns
+func (pk PrimaryKey) Cols() []string {
+	return pk.cols
+}
+
+// PrimaryKeys returns the primary key columns of each table, by table name
+func (s *Schema) PrimaryKeys() map[string][]string {
+	keys := make(map[string][]string, len(s.Tables))
+	for _, t := range s.Tables {
+		keys[t.Name] = t.PrimaryKeys.Cols()
+	}
+	return keys
+}
+
 // Col is the name and index of a column in a table
 type Col struct {
 	name string
@@ -139,3 +207,40 @@ type ForeignKey struct {
 	foreignTable string
 	primaryTable string
 }
+
+// PolymorphicRef represents a Rails-style polymorphic reference, where the
+// columns "<name>_type" and "<name>_id" hold the type and id of the row it
+// references, e.g. commentable_type and commentable_id
+type PolymorphicRef struct {
+	name    string
+	typeCol string
+	idCol   string
+	// values are (some of) the distinct values of the type column
+	values []string
+}
+
+// polymorphicRefs finds the pairs of type and id columns of a table,
+// skipping id columns that are covered by a foreign key
+func polymorphicRefs(t *Table) []PolymorphicRef {
+	cols := make(map[string]struct{}, len(t.Cols))
+	for _, c := range t.Cols {
+		cols[c.name] = struct{}{}
+	}
+	for _, fk := range t.ForeignKeys {
+		for _, c := range fk.cols {
+			delete(cols, c)
+		}
+	}
+	refs := make([]PolymorphicRef, 0)
+	for _, c := range t.Cols {
+		if !strings.HasSuffix(c.name, "_type") || c.name == "_type" {
+			continue
+		}
+		name := strings.TrimSuffix(c.name, "_type")
+		if _, ok := cols[name+"_id"]; !ok {
+			continue
+		}
+		refs = append(refs, PolymorphicRef{name: name, typeCol: c.name, idCol: name + "_id"})
+	}
+	return refs
+}
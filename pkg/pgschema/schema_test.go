@@ -0,0 +1,79 @@
+package pgschema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/authzed/connector-postgresql/pkg/config"
+)
+
+func testSchema() *Schema {
+	return &Schema{Tables: []*Table{
+		{Name: "users", PrimaryKeys: PrimaryKey{cols: []string{"id"}}},
+		{Name: "posts", PrimaryKeys: PrimaryKey{cols: []string{"id"}}},
+		{
+			Name:        "comments",
+			PrimaryKeys: PrimaryKey{cols: []string{"id"}},
+			ForeignKeys: []ForeignKey{
+				{name: "comments_user_id_fkey", cols: []string{"user_id"}, foreignTable: "comments", primaryTable: "users"},
+			},
+			PolymorphicRefs: []PolymorphicRef{
+				{name: "commentable", typeCol: "commentable_type", idCol: "commentable_id", values: []string{"Post", "User", "Photo"}},
+				// none of the values name a table
+				{name: "owner", typeCol: "owner_type", idCol: "owner_id", values: []string{"Team"}},
+			},
+		},
+	}}
+}
+
+func TestToTableMapping(t *testing.T) {
+	require.Equal(t, []config.TableMapping{
+		{Name: "users", Relationships: []config.RowMapping{}},
+		{Name: "posts", Relationships: []config.RowMapping{}},
+		{Name: "comments", Relationships: []config.RowMapping{
+			{
+				ResourceType:   "comments",
+				Relation:       "comments_user_id_fkey",
+				SubjectType:    "users",
+				ResourceIDCols: []string{"id"},
+				SubjectIDCols:  []string{"user_id"},
+			},
+			{
+				ResourceType:       "comments",
+				Relation:           "commentable",
+				ResourceIDCols:     []string{"id"},
+				SubjectIDCols:      []string{"commentable_id"},
+				SubjectTypeFromCol: "commentable_type",
+				SubjectTypeMap:     map[string]string{"Post": "posts", "User": "users"},
+			},
+		}},
+	}, testSchema().ToTableMapping())
+}
+
+func TestToZedSchema(t *testing.T) {
+	require.Equal(t, `
+definition users {}
+
+definition posts {}
+
+definition comments {
+    relation comments_user_id_fkey: users
+    relation commentable: posts | users
+}
+`, testSchema().ToZedSchema())
+}
+
+func TestNormalizeTypeName(t *testing.T) {
+	for _, names := range [][]string{
+		{"Post", "post", "posts"},
+		{"BlogPost", "blog_posts"},
+		{"Category", "categories"},
+		{"Box", "boxes"},
+		{"Address", "addresses"},
+	} {
+		for _, name := range names[1:] {
+			require.Equal(t, normalizeTypeName(names[0]), normalizeTypeName(name), name)
+		}
+	}
+}
@@ -142,6 +142,51 @@ func syncColIds(ctx context.Context, tx pgx.Tx, name string) ([]Col, error) {
 	return cols, nil
 }
 
+// SyncPolymorphicRefs finds the polymorphic references of the schema's
+// tables and reads some of the values of their type columns, so that
+// ToTableMapping can suggest mappings for them. Reading the values scans the
+// tables, so this is only worth doing when generating a config.
+func (s *Schema) SyncPolymorphicRefs(ctx context.Context, conn *pgxpool.Pool) error {
+	for _, t := range s.Tables {
+		refs, err := syncPolymorphicRefs(ctx, conn, t)
+		if err != nil {
+			return err
+		}
+		t.PolymorphicRefs = refs
+	}
+	return nil
+}
+
+func syncPolymorphicRefs(ctx context.Context, conn *pgxpool.Pool, t *Table) ([]PolymorphicRef, error) {
+	refs := polymorphicRefs(t)
+	for i, ref := range refs {
+		rows, err := conn.Query(ctx, fmt.Sprintf(querySelectTypeValues, pgx.Identifier{ref.typeCol}.Sanitize(), tableIdentifier(t.Name)))
+		if err != nil {
+			return nil, err
+		}
+		values := make([]string, 0)
+		for rows.Next() {
+			var v string
+			if err := rows.Scan(&v); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		refs[i].values = values
+	}
+	return refs, nil
+}
+
+// tableIdentifier quotes a table name, which may be qualified with a schema
+func tableIdentifier(name string) string {
+	return pgx.Identifier(strings.SplitN(name, ".", 2)).Sanitize()
+}
+
 func syncPrimaryKeys(ctx context.Context, tx pgx.Tx, name string) (*PrimaryKey, error) {
 	pknums := make([]int, 0)
 	pks := make([]string, 0)
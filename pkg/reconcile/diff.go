@@ -0,0 +1,268 @@
+// Package reconcile compares the relationships that postgres should produce
+// with the ones that are stored in SpiceDB.
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog/log"
+
+	"github.com/authzed/connector-postgresql/pkg/config"
+	"github.com/authzed/connector-postgresql/pkg/importer"
+	"github.com/authzed/connector-postgresql/pkg/util"
+)
+
+// Group is a set of relationships with the same resource type, relation and
+// subject type. SpiceDB can only be filtered this far, so RowMappings that
+// generate the same kind of relationships are compared together.
+type Group struct {
+	ResourceType string   `json:"resource_type"`
+	Relation     string   `json:"relation"`
+	SubjectType  string   `json:"subject_type"`
+	Tables       []string `json:"tables"`
+
+	mappings []tableRowMapping
+}
+
+type tableRowMapping struct {
+	table string
+	rm    config.RowMapping
+}
+
+// Filter returns the filter that reads the group's relationships from SpiceDB
+func (g Group) Filter() *v1.RelationshipFilter {
+	return &v1.RelationshipFilter{
+		ResourceType:     g.ResourceType,
+		OptionalRelation: g.Relation,
+		OptionalSubjectFilter: &v1.SubjectFilter{
+			SubjectType: g.SubjectType,
+		},
+	}
+}
+
+// Diff holds the differences between postgres and SpiceDB for a group
+type Diff struct {
+	Group
+	// Missing relationships have a source row in postgres but are not in
+	// SpiceDB
+	Missing []*v1.Relationship
+	// Extra relationships are in SpiceDB but have no source row in postgres.
+	// They can't be attributed to a table, only to the group.
+	Extra []*v1.Relationship
+	// Mappings attributes the missing relationships to the table and
+	// RowMapping that generate them
+	Mappings []MappingDiff
+}
+
+// MappingDiff holds the missing relationships of a group that a table's
+// RowMapping generates. A relationship that several RowMappings generate is
+// attributed to the first of them.
+type MappingDiff struct {
+	Table   string
+	Mapping string
+	Missing []*v1.Relationship
+}
+
+// Empty returns true if postgres and SpiceDB agree
+func (d Diff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0
+}
+
+// RelationLabel returns the group's relation, or * if it has every relation
+func (g Group) RelationLabel() string {
+	if g.Relation == "" {
+		return "*"
+	}
+	return g.Relation
+}
+
+// Groups collects the RowMappings of the config into groups, in the order
+// they first appear. RowMappings that take their relation from a column are
+// in a group for each relation they map to. If they use the column's values
+// as relations, they are grouped with every RowMapping of the same resource
+// and subject types, and the group reads relationships with any relation
+// from SpiceDB.
+// RowMappings that take their types from columns are in a group for each
+// combination of types they can generate.
+func Groups(mapping []config.TableMapping) []*Group {
+	anyRelation := make(map[[2]string]struct{}, 0)
+	for _, tm := range mapping {
+		for _, rm := range tm.Relationships {
+			if rm.Relations() != nil {
+				continue
+			}
+			log.Warn().Str("table", tm.Name).Stringer("mapping", rm).Msg("relation column values are used as relations, comparing relationships with any relation between the types")
+			for _, resourceType := range rm.ResourceTypes() {
+				for _, subjectType := range rm.SubjectTypes() {
+					anyRelation[[2]string{resourceType, subjectType}] = struct{}{}
+				}
+			}
+		}
+	}
+
+	groups := make([]*Group, 0)
+	byKey := make(map[[3]string]*Group, 0)
+	for _, tm := range mapping {
+		for _, rm := range tm.Relationships {
+			for _, resourceType := range rm.ResourceTypes() {
+				for _, subjectType := range rm.SubjectTypes() {
+					relations := rm.Relations()
+					if _, ok := anyRelation[[2]string{resourceType, subjectType}]; ok {
+						relations = []string{""}
+					}
+					for _, relation := range relations {
+						key := [3]string{resourceType, relation, subjectType}
+						g, ok := byKey[key]
+						if !ok {
+							g = &Group{
+								ResourceType: resourceType,
+								Relation:     relation,
+								SubjectType:  subjectType,
+								Tables:       make([]string, 0),
+								mappings:     make([]tableRowMapping, 0),
+							}
+							byKey[key] = g
+							groups = append(groups, g)
+						}
+						if len(g.Tables) == 0 || g.Tables[len(g.Tables)-1] != tm.Name {
+							g.Tables = append(g.Tables, tm.Name)
+						}
+						g.mappings = append(g.mappings, tableRowMapping{table: tm.Name, rm: rm})
+					}
+				}
+			}
+		}
+	}
+	return groups
+}
+
+// contains returns whether the relationship is one of the group's
+func (g Group) contains(rel *v1.Relationship) bool {
+	return rel.Resource.ObjectType == g.ResourceType &&
+		rel.Subject.Object.ObjectType == g.SubjectType &&
+		(g.Relation == "" || rel.Relation == g.Relation)
+}
+
+// Differ computes the differences between postgres and SpiceDB
+type Differ struct {
+	conn    *pgxpool.Pool
+	client  v1.PermissionsServiceClient
+	mapping []config.TableMapping
+}
+
+// NewDiffer returns a Differ for the mapping
+func NewDiffer(conn *pgxpool.Pool, client v1.PermissionsServiceClient, mapping []config.TableMapping) *Differ {
+	return &Differ{
+		conn:    conn,
+		client:  client,
+		mapping: mapping,
+	}
+}
+
+// Diff compares each group of relationships in the mapping and calls fn
+// with the result, so that large diffs don't have to be held for every group
+// at once.
+func (d *Differ) Diff(ctx context.Context, fn func(Diff) error) error {
+	for _, g := range Groups(d.mapping) {
+		diff, err := d.diffGroup(ctx, g)
+		if err != nil {
+			return err
+		}
+		if err := fn(diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffGroup reads the group's relationships from SpiceDB before reading the
+// rows from postgres. Changes that are synced in between then show up as
+// missing rather than extra, so they are never deleted by mistake.
+func (d *Differ) diffGroup(ctx context.Context, g *Group) (Diff, error) {
+	log.Info().Str("resourceType", g.ResourceType).Str("relation", g.RelationLabel()).Str("subjectType", g.SubjectType).Msg("reading relationships from spicedb")
+	actual, err := d.readSpiceDB(ctx, g)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	tx, err := d.conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return Diff{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	missing := make([]*v1.Relationship, 0)
+	mappings := make([]MappingDiff, 0, len(g.mappings))
+	seen := make(map[string]struct{}, len(actual))
+	for _, m := range g.mappings {
+		log.Info().Str("table", m.table).Str("relation", m.rm.RelationLabel()).Msg("reading rows from postgres")
+		md := MappingDiff{Table: m.table, Mapping: m.rm.String(), Missing: make([]*v1.Relationship, 0)}
+		err := importer.ScanRelationships(ctx, tx, m.table, m.rm, func(rel *v1.Relationship) error {
+			// mappings with types from columns also generate relationships
+			// of other groups
+			if !g.contains(rel) {
+				return nil
+			}
+			key := util.RelString(rel)
+			if _, ok := seen[key]; ok {
+				return nil
+			}
+			seen[key] = struct{}{}
+			if _, ok := actual[key]; ok {
+				delete(actual, key)
+				return nil
+			}
+			missing = append(missing, rel)
+			md.Missing = append(md.Missing, rel)
+			return nil
+		})
+		if err != nil {
+			return Diff{}, err
+		}
+		sortRelationships(md.Missing)
+		mappings = append(mappings, md)
+	}
+
+	extra := make([]*v1.Relationship, 0, len(actual))
+	for _, rel := range actual {
+		extra = append(extra, rel)
+	}
+	sortRelationships(extra)
+	sortRelationships(missing)
+	return Diff{Group: *g, Missing: missing, Extra: extra, Mappings: mappings}, nil
+}
+
+func (d *Differ) readSpiceDB(ctx context.Context, g *Group) (map[string]*v1.Relationship, error) {
+	stream, err := d.client.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true},
+		},
+		RelationshipFilter: g.Filter(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	rels := make(map[string]*v1.Relationship, 0)
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return rels, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rels[util.RelString(resp.Relationship)] = resp.Relationship
+	}
+}
+
+func sortRelationships(rels []*v1.Relationship) {
+	sort.Slice(rels, func(i, j int) bool {
+		return util.RelString(rels[i]) < util.RelString(rels[j])
+	})
+}
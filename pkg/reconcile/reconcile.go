@@ -0,0 +1,70 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/rs/zerolog/log"
+
+	"github.com/authzed/connector-postgresql/pkg/util"
+	"github.com/authzed/connector-postgresql/pkg/write"
+)
+
+// DeleteExtra deletes the relationships that are in SpiceDB but have no
+// source row in postgres, batchSize relationships per request
+func DeleteExtra(ctx context.Context, writer write.RelationshipWriter, diff Diff, batchSize int) error {
+	for start := 0; start < len(diff.Extra); start += batchSize {
+		end := start + batchSize
+		if end > len(diff.Extra) {
+			end = len(diff.Extra)
+		}
+		updates := make([]*v1.RelationshipUpdate, 0, end-start)
+		for _, rel := range diff.Extra[start:end] {
+			updates = append(updates, &v1.RelationshipUpdate{
+				Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
+				Relationship: rel,
+			})
+		}
+		if err := writer.Write(ctx, updates); err != nil {
+			return err
+		}
+	}
+	log.Info().Str("resourceType", diff.ResourceType).Str("relation", diff.RelationLabel()).Str("subjectType", diff.SubjectType).Int("deleted", len(diff.Extra)).Msg("deleted stale relationships")
+	return nil
+}
+
+// TextPrinter prints a diff as a summary line, followed by the missing (+)
+// relationships of each table and RowMapping and the extra (-) relationships
+// of the group, which have no source row in any table
+func TextPrinter(w io.Writer) func(Diff) error {
+	return func(d Diff) error {
+		if _, err := fmt.Fprintf(w, "%s#%s@%s (%s): %d missing, %d extra\n", d.ResourceType, d.RelationLabel(), d.SubjectType, strings.Join(d.Tables, ", "), len(d.Missing), len(d.Extra)); err != nil {
+			return err
+		}
+		for _, m := range d.Mappings {
+			if _, err := fmt.Fprintf(w, "  %s %s: %d missing\n", m.Table, m.Mapping, len(m.Missing)); err != nil {
+				return err
+			}
+			for _, rel := range m.Missing {
+				if _, err := fmt.Fprintf(w, "    + %s\n", util.RelString(rel)); err != nil {
+					return err
+				}
+			}
+		}
+		if len(d.Extra) == 0 {
+			return nil
+		}
+		if _, err := fmt.Fprintf(w, "  no source row: %d extra\n", len(d.Extra)); err != nil {
+			return err
+		}
+		for _, rel := range d.Extra {
+			if _, err := fmt.Fprintf(w, "    - %s\n", util.RelString(rel)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
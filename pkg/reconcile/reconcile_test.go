@@ -0,0 +1,132 @@
+package reconcile
+
+import (
+	"bytes"
+	"testing"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/authzed/connector-postgresql/pkg/config"
+)
+
+func tag(articleID, tagID string) *v1.Relationship {
+	return &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: "article", ObjectId: articleID},
+		Relation: "tags",
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "tags", ObjectId: tagID}},
+	}
+}
+
+func testDiff() Diff {
+	return Diff{
+		Group: Group{
+			ResourceType: "article",
+			Relation:     "tags",
+			SubjectType:  "tags",
+			Tables:       []string{"article_tag", "featured_tag"},
+		},
+		Missing: []*v1.Relationship{tag("1", "3"), tag("5", "1")},
+		Extra:   []*v1.Relationship{tag("2", "2")},
+		Mappings: []MappingDiff{
+			{Table: "article_tag", Mapping: "article#tags@tags", Missing: []*v1.Relationship{tag("1", "3")}},
+			{Table: "featured_tag", Mapping: "article#tags@tags", Missing: []*v1.Relationship{tag("5", "1")}},
+		},
+	}
+}
+
+func TestTextPrinter(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, TextPrinter(&out)(testDiff()))
+	require.Equal(t, `article#tags@tags (article_tag, featured_tag): 2 missing, 1 extra
+  article_tag article#tags@tags: 1 missing
+    + article:1#tags@tags:3
+  featured_tag article#tags@tags: 1 missing
+    + article:5#tags@tags:1
+  no source row: 1 extra
+    - article:2#tags@tags:2
+`, out.String())
+}
+
+func TestReport(t *testing.T) {
+	report := NewReport()
+	require.NoError(t, report.Add(Diff{Group: Group{ResourceType: "contact", Relation: "owner", SubjectType: "user", Tables: []string{"contacts"}}, Mappings: []MappingDiff{{Table: "contacts", Mapping: "contact#owner@user"}}}))
+	require.True(t, report.InSync)
+	require.NoError(t, report.Add(testDiff()))
+	require.False(t, report.InSync)
+
+	var out bytes.Buffer
+	require.NoError(t, report.WriteJSON(&out))
+	require.JSONEq(t, `{
+		"in_sync": false,
+		"groups": [
+			{
+				"resource_type": "contact", "relation": "owner", "subject_type": "user", "tables": ["contacts"],
+				"mappings": [{"table": "contacts", "mapping": "contact#owner@user", "missing": []}],
+				"extra": []
+			},
+			{
+				"resource_type": "article", "relation": "tags", "subject_type": "tags", "tables": ["article_tag", "featured_tag"],
+				"mappings": [
+					{"table": "article_tag", "mapping": "article#tags@tags", "missing": ["article:1#tags@tags:3"]},
+					{"table": "featured_tag", "mapping": "article#tags@tags", "missing": ["article:5#tags@tags:1"]}
+				],
+				"extra": ["article:2#tags@tags:2"]
+			}
+		]
+	}`, out.String())
+}
+
+func TestGroups(t *testing.T) {
+	owner := config.RowMapping{ResourceType: "contact", Relation: "owner", SubjectType: "user", ResourceIDCols: []string{"id"}, SubjectIDCols: []string{"owner_id"}}
+	roles := config.RowMapping{
+		ResourceType:    "org",
+		RelationFromCol: "role",
+		RelationMap:     map[string]string{"admin": "admin", "member": "member"},
+		SubjectType:     "user",
+		ResourceIDCols:  []string{"org_id"},
+		SubjectIDCols:   []string{"user_id"},
+	}
+	passthrough := roles
+	passthrough.RelationMap = nil
+	passthrough.UnknownRelation = config.UnknownRelationPassthrough
+	typed := config.RowMapping{
+		ResourceType:       "comment",
+		Relation:           "commentable",
+		SubjectTypeFromCol: "commentable_type",
+		SubjectTypeMap:     map[string]string{"Post": "post", "Photo": "photo"},
+		ResourceIDCols:     []string{"id"},
+		SubjectIDCols:      []string{"commentable_id"},
+	}
+
+	labels := func(groups []*Group) []string {
+		l := make([]string, 0, len(groups))
+		for _, g := range groups {
+			l = append(l, g.ResourceType+"#"+g.RelationLabel()+"@"+g.SubjectType)
+		}
+		return l
+	}
+
+	groups := Groups([]config.TableMapping{
+		{Name: "contacts", Relationships: []config.RowMapping{owner}},
+		{Name: "shared_contacts", Relationships: []config.RowMapping{owner}},
+		{Name: "memberships", Relationships: []config.RowMapping{roles}},
+		{Name: "comments", Relationships: []config.RowMapping{typed}},
+	})
+	require.Equal(t, []string{"contact#owner@user", "org#admin@user", "org#member@user", "comment#commentable@photo", "comment#commentable@post"}, labels(groups))
+	require.Equal(t, []string{"contacts", "shared_contacts"}, groups[0].Tables)
+	require.Len(t, groups[0].mappings, 2)
+
+	// a passthrough mapping puts every mapping of its types in one group
+	groups = Groups([]config.TableMapping{
+		{Name: "memberships", Relationships: []config.RowMapping{roles}},
+		{Name: "invites", Relationships: []config.RowMapping{passthrough}},
+	})
+	require.Equal(t, []string{"org#*@user"}, labels(groups))
+	require.Equal(t, []string{"memberships", "invites"}, groups[0].Tables)
+	require.True(t, groups[0].contains(&v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: "org", ObjectId: "1"},
+		Relation: "billing",
+		Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "1"}},
+	}))
+}
@@ -0,0 +1,74 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"io"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/authzed/connector-postgresql/pkg/util"
+)
+
+// Report collects diffs so they can be printed together as JSON
+type Report struct {
+	InSync bool          `json:"in_sync"`
+	Groups []ReportEntry `json:"groups"`
+}
+
+// ReportEntry is the diff of a group, with relationships formatted as
+// strings. Missing relationships are listed by the table and RowMapping that
+// generate them, extra ones only by group.
+type ReportEntry struct {
+	Group
+	Mappings []ReportMapping `json:"mappings"`
+	Extra    []string        `json:"extra"`
+}
+
+// ReportMapping is the missing relationships of a table and RowMapping
+type ReportMapping struct {
+	Table   string   `json:"table"`
+	Mapping string   `json:"mapping"`
+	Missing []string `json:"missing"`
+}
+
+// NewReport returns an empty report, which is in sync
+func NewReport() *Report {
+	return &Report{
+		InSync: true,
+		Groups: make([]ReportEntry, 0),
+	}
+}
+
+// Add adds a diff to the report
+func (r *Report) Add(d Diff) error {
+	r.InSync = r.InSync && d.Empty()
+	mappings := make([]ReportMapping, 0, len(d.Mappings))
+	for _, m := range d.Mappings {
+		mappings = append(mappings, ReportMapping{
+			Table:   m.Table,
+			Mapping: m.Mapping,
+			Missing: relStrings(m.Missing),
+		})
+	}
+	r.Groups = append(r.Groups, ReportEntry{
+		Group:    d.Group,
+		Mappings: mappings,
+		Extra:    relStrings(d.Extra),
+	})
+	return nil
+}
+
+// WriteJSON writes the report to w as indented JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func relStrings(rels []*v1.Relationship) []string {
+	strs := make([]string, 0, len(rels))
+	for _, rel := range rels {
+		strs = append(strs, util.RelString(rel))
+	}
+	return strs
+}
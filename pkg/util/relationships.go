@@ -20,5 +20,61 @@ func RelString(r *v1.Relationship) string {
 	if r.Subject.Object == nil {
 		r.Subject.Object = &v1.ObjectReference{}
 	}
-	return fmt.Sprintf("%s:%s#%s@%s:%s", r.Resource.ObjectType, r.Resource.ObjectId, r.Relation, r.Subject.Object.ObjectType, r.Subject.Object.ObjectId)
+	subject := fmt.Sprintf("%s:%s", r.Subject.Object.ObjectType, r.Subject.Object.ObjectId)
+	if r.Subject.OptionalRelation != "" {
+		subject += "#" + r.Subject.OptionalRelation
+	}
+	return fmt.Sprintf("%s:%s#%s@%s", r.Resource.ObjectType, r.Resource.ObjectId, r.Relation, subject)
+}
+
+// FilterString best-effort formats a relationship filter for debug logging.
+// Parts of the relationship that aren't filtered on are shown as `*`.
+func FilterString(f *v1.RelationshipFilter) string {
+	if f == nil {
+		return ""
+	}
+	orAny := func(s string) string {
+		if s == "" {
+			return "*"
+		}
+		return s
+	}
+	subject := "*:*"
+	if f.OptionalSubjectFilter != nil {
+		subject = fmt.Sprintf("%s:%s", orAny(f.OptionalSubjectFilter.SubjectType), orAny(f.OptionalSubjectFilter.OptionalSubjectId))
+		if rf := f.OptionalSubjectFilter.OptionalRelation; rf != nil {
+			subject += "#" + orAny(rf.Relation)
+		}
+	}
+	return fmt.Sprintf("%s:%s#%s@%s", f.ResourceType, orAny(f.OptionalResourceId), orAny(f.OptionalRelation), subject)
+}
+
+// FilterMatches returns whether the relationship filter matches the
+// relationship, as it would when reading or deleting relationships from
+// SpiceDB
+func FilterMatches(f *v1.RelationshipFilter, r *v1.Relationship) bool {
+	if r.Resource.ObjectType != f.ResourceType {
+		return false
+	}
+	if f.OptionalResourceId != "" && r.Resource.ObjectId != f.OptionalResourceId {
+		return false
+	}
+	if f.OptionalRelation != "" && r.Relation != f.OptionalRelation {
+		return false
+	}
+	sf := f.OptionalSubjectFilter
+	if sf == nil {
+		return true
+	}
+	if r.Subject.Object.ObjectType != sf.SubjectType {
+		return false
+	}
+	if sf.OptionalSubjectId != "" && r.Subject.Object.ObjectId != sf.OptionalSubjectId {
+		return false
+	}
+	// a relation filter with an empty relation only matches plain subjects
+	if sf.OptionalRelation != nil && r.Subject.OptionalRelation != sf.OptionalRelation.Relation {
+		return false
+	}
+	return true
 }
@@ -0,0 +1,91 @@
+package write
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/status"
+
+	"github.com/authzed/connector-postgresql/pkg/util"
+)
+
+// Letter is a request that SpiceDB rejected
+type Letter struct {
+	Time    time.Time `json:"time"`
+	Code    string    `json:"code"`
+	Error   string    `json:"error"`
+	Updates []string  `json:"updates,omitempty"`
+	Filter  string    `json:"filter,omitempty"`
+}
+
+// NewLetter describes a write of updates, or a delete by filter, that failed
+// with err
+func NewLetter(err error, updates []*v1.RelationshipUpdate, filter *v1.RelationshipFilter) Letter {
+	l := Letter{
+		Time:  time.Now().UTC(),
+		Code:  status.Code(err).String(),
+		Error: err.Error(),
+	}
+	for _, u := range updates {
+		l.Updates = append(l.Updates, u.Operation.String()+" "+util.RelString(u.Relationship))
+	}
+	if filter != nil {
+		l.Filter = util.FilterString(filter)
+	}
+	return l
+}
+
+// DeadLetter records requests that SpiceDB rejected, so that they can be
+// inspected and fixed by hand
+type DeadLetter interface {
+	Add(ctx context.Context, l Letter) error
+}
+
+// LoggingDeadLetter logs rejected requests
+type LoggingDeadLetter struct{}
+
+var _ DeadLetter = LoggingDeadLetter{}
+
+func (d LoggingDeadLetter) Add(ctx context.Context, l Letter) error {
+	log.Error().Str("code", l.Code).Str("error", l.Error).Strs("updates", l.Updates).Str("filter", l.Filter).Msg("SpiceDB rejected request, skipping it")
+	return nil
+}
+
+// FileDeadLetter appends rejected requests to a file, one JSON object per
+// line, and logs them
+type FileDeadLetter struct {
+	sync.Mutex
+	path string
+}
+
+var _ DeadLetter = &FileDeadLetter{}
+
+// NewFileDeadLetter returns a DeadLetter that appends to the file at path
+func NewFileDeadLetter(path string) *FileDeadLetter {
+	return &FileDeadLetter{path: path}
+}
+
+func (d *FileDeadLetter) Add(ctx context.Context, l Letter) error {
+	_ = LoggingDeadLetter{}.Add(ctx, l)
+
+	line, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,68 @@
+package write
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/rs/zerolog/log"
+
+	"github.com/authzed/connector-postgresql/pkg/util"
+)
+
+// RelationshipReader reads the relationships that match a filter
+type RelationshipReader interface {
+	Read(context.Context, *v1.RelationshipFilter) ([]*v1.Relationship, error)
+}
+
+// NewRelationshipReader returns a RelationshipReader that reads via an
+// authzed client, or one that reads nothing if no client is passed
+func NewRelationshipReader(client *authzed.Client) RelationshipReader {
+	if client == nil {
+		return DryRunRelationshipReader{}
+	}
+	return StdRelationshipReader{client: client}
+}
+
+// StdRelationshipReader reads fully consistently via an authzed client
+type StdRelationshipReader struct {
+	client *authzed.Client
+}
+
+func (r StdRelationshipReader) Read(ctx context.Context, filter *v1.RelationshipFilter) ([]*v1.Relationship, error) {
+	start := time.Now()
+	stream, err := r.client.ReadRelationships(ctx, &v1.ReadRelationshipsRequest{
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true},
+		},
+		RelationshipFilter: filter,
+	})
+	if err != nil {
+		observeRequest("ReadRelationships", start, err)
+		return nil, err
+	}
+	rels := make([]*v1.Relationship, 0)
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			observeRequest("ReadRelationships", start, nil)
+			return rels, nil
+		}
+		if err != nil {
+			observeRequest("ReadRelationships", start, err)
+			return nil, err
+		}
+		rels = append(rels, resp.Relationship)
+	}
+}
+
+// DryRunRelationshipReader logs filters and reads nothing
+type DryRunRelationshipReader struct{}
+
+func (r DryRunRelationshipReader) Read(ctx context.Context, filter *v1.RelationshipFilter) ([]*v1.Relationship, error) {
+	log.Info().Str("filter", util.FilterString(filter)).Msg("READ_MATCHING")
+	return nil, nil
+}
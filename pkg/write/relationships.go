@@ -2,29 +2,39 @@ package write
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/authzed/authzed-go/proto/authzed/api/v1"
 	"github.com/authzed/authzed-go/v1"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/status"
 
+	"github.com/authzed/connector-postgresql/pkg/metrics"
 	"github.com/authzed/connector-postgresql/pkg/util"
 )
 
 // RelationshipWriter writes v1 relationships
 type RelationshipWriter interface {
 	Write(context.Context, []*v1.RelationshipUpdate) error
+	// Delete removes every relationship that matches the filter
+	Delete(context.Context, *v1.RelationshipFilter) error
 }
 
 // NewBatchingRelationshipWriter will write relationships in batches of size
-// batchSize
-func NewBatchingRelationshipWriter(writer RelationshipWriter, batchSize int) RelationshipWriter {
-	if batchSize == 0 {
+// batchSize, sending up to concurrency batches at a time
+func NewBatchingRelationshipWriter(writer RelationshipWriter, batchSize, concurrency int) RelationshipWriter {
+	if batchSize <= 0 {
 		return writer
 	}
-	return &BatchingRelationshipWriter{
-		writer:    writer,
-		batchSize: batchSize,
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return BatchingRelationshipWriter{
+		writer:      writer,
+		batchSize:   batchSize,
+		concurrency: concurrency,
 	}
 }
 
@@ -48,26 +58,184 @@ type StdRelationshipWriter struct {
 }
 
 func (w StdRelationshipWriter) Write(ctx context.Context, updates []*v1.RelationshipUpdate) error {
+	start := time.Now()
 	_, err := w.client.WriteRelationships(ctx, &v1.WriteRelationshipsRequest{Updates: updates})
-	return err
+	observeRequest("WriteRelationships", start, err)
+	if err != nil {
+		return err
+	}
+	for _, u := range updates {
+		metrics.RelationshipUpdates.WithLabelValues(u.Relationship.Resource.ObjectType, operationLabel(u.Operation)).Inc()
+	}
+	return nil
 }
 
-// BatchingRelationshipWriter writes in batches of batchSize
+func (w StdRelationshipWriter) Delete(ctx context.Context, filter *v1.RelationshipFilter) error {
+	start := time.Now()
+	_, err := w.client.DeleteRelationships(ctx, &v1.DeleteRelationshipsRequest{RelationshipFilter: filter})
+	observeRequest("DeleteRelationships", start, err)
+	if err != nil {
+		return err
+	}
+	metrics.RelationshipUpdates.WithLabelValues(filter.ResourceType, "delete_by_filter").Inc()
+	return nil
+}
+
+func observeRequest(method string, start time.Time, err error) {
+	metrics.RequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.RequestErrors.WithLabelValues(method, status.Code(err).String()).Inc()
+	}
+}
+
+func operationLabel(op v1.RelationshipUpdate_Operation) string {
+	switch op {
+	case v1.RelationshipUpdate_OPERATION_TOUCH:
+		return "touch"
+	case v1.RelationshipUpdate_OPERATION_DELETE:
+		return "delete"
+	case v1.RelationshipUpdate_OPERATION_CREATE:
+		return "create"
+	default:
+		return "unspecified"
+	}
+}
+
+// BatchingRelationshipWriter writes in batches of batchSize. Updates to the
+// same relationship are merged before batching, since SpiceDB rejects
+// requests that update a relationship more than once. This also makes the
+// batches independent of each other, so they can be sent concurrently.
+// Batches are not atomic with each other.
 type BatchingRelationshipWriter struct {
-	writer    RelationshipWriter
-	batchSize int
+	writer      RelationshipWriter
+	batchSize   int
+	concurrency int
 }
 
 func (w BatchingRelationshipWriter) Write(ctx context.Context, updates []*v1.RelationshipUpdate) error {
-	for i, start, end := 0, 0, w.batchSize; end <= len(updates)-1; i, start, end = i+1, (i+1)*w.batchSize, (i+2)*w.batchSize {
-		if end > len(updates)-1 {
-			end = len(updates) - 1
+	updates = dedupe(updates)
+	batches := make([][]*v1.RelationshipUpdate, 0, len(updates)/w.batchSize+1)
+	for start := 0; start < len(updates); start += w.batchSize {
+		end := start + w.batchSize
+		if end > len(updates) {
+			end = len(updates)
 		}
-		if err := w.writer.Write(ctx, updates[start:end]); err != nil {
-			return err
+		batches = append(batches, updates[start:end])
+	}
+
+	if w.concurrency <= 1 || len(batches) <= 1 {
+		for _, batch := range batches {
+			if err := w.writer.Write(ctx, batch); err != nil {
+				return err
+			}
 		}
+		return nil
 	}
-	return nil
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	slots := make(chan struct{}, w.concurrency)
+	for _, batch := range batches {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(batch []*v1.RelationshipUpdate) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := w.writer.Write(ctx, batch); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(batch)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// dedupe merges updates to the same relationship. The last update wins, as
+// it would if the updates were applied one after the other.
+func dedupe(updates []*v1.RelationshipUpdate) []*v1.RelationshipUpdate {
+	last := make(map[string]int, len(updates))
+	for i, u := range updates {
+		last[util.RelString(u.Relationship)] = i
+	}
+	if len(last) == len(updates) {
+		return updates
+	}
+	deduped := make([]*v1.RelationshipUpdate, 0, len(last))
+	for i, u := range updates {
+		if last[util.RelString(u.Relationship)] == i {
+			deduped = append(deduped, u)
+		}
+	}
+	return deduped
+}
+
+func (w BatchingRelationshipWriter) Delete(ctx context.Context, filter *v1.RelationshipFilter) error {
+	return w.writer.Delete(ctx, filter)
+}
+
+// NewLimitingRelationshipWriter allows at most limit writes and deletes to
+// be in flight at a time, no matter how many goroutines share the writer
+func NewLimitingRelationshipWriter(writer RelationshipWriter, limit int) RelationshipWriter {
+	if limit <= 0 {
+		return writer
+	}
+	return &LimitingRelationshipWriter{
+		writer: writer,
+		slots:  make(chan struct{}, limit),
+	}
+}
+
+// LimitingRelationshipWriter limits the number of concurrent requests to an
+// underlying RelationshipWriter
+type LimitingRelationshipWriter struct {
+	writer RelationshipWriter
+	slots  chan struct{}
+}
+
+func (w *LimitingRelationshipWriter) Write(ctx context.Context, updates []*v1.RelationshipUpdate) error {
+	if err := w.acquire(ctx); err != nil {
+		return err
+	}
+	defer w.release()
+	return w.writer.Write(ctx, updates)
+}
+
+func (w *LimitingRelationshipWriter) Delete(ctx context.Context, filter *v1.RelationshipFilter) error {
+	if err := w.acquire(ctx); err != nil {
+		return err
+	}
+	defer w.release()
+	return w.writer.Delete(ctx, filter)
+}
+
+func (w *LimitingRelationshipWriter) acquire(ctx context.Context) error {
+	select {
+	case w.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *LimitingRelationshipWriter) release() {
+	<-w.slots
 }
 
 // LoggingRelationshipWriter will log each write before delegating to an
@@ -85,6 +253,12 @@ func (w LoggingRelationshipWriter) Write(ctx context.Context, updates []*v1.Rela
 	return err
 }
 
+func (w LoggingRelationshipWriter) Delete(ctx context.Context, filter *v1.RelationshipFilter) error {
+	err := w.writer.Delete(ctx, filter)
+	log.WithLevel(w.level).Str("filter", util.FilterString(filter)).Msg("DELETE_MATCHING")
+	return err
+}
+
 // NewDryRunRelationshipWriter constructs a new relationship writer that logs
 // but doesn't write.
 func NewDryRunRelationshipWriter() RelationshipWriter {
@@ -100,3 +274,7 @@ type DiscardingRelationshipWriter struct{}
 func (w DiscardingRelationshipWriter) Write(ctx context.Context, updates []*v1.RelationshipUpdate) error {
 	return nil
 }
+
+func (w DiscardingRelationshipWriter) Delete(ctx context.Context, filter *v1.RelationshipFilter) error {
+	return nil
+}
@@ -0,0 +1,199 @@
+package write
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/status"
+)
+
+// fakeWriter records the requests it gets, and fails them with the errors in
+// errs, in order, until they run out
+type fakeWriter struct {
+	sync.Mutex
+	writes  [][]*v1.RelationshipUpdate
+	deletes []*v1.RelationshipFilter
+	errs    []error
+	// delay makes each request take that long, or until its context is
+	// done
+	delay time.Duration
+	// requests counts the requests, including failed ones
+	requests int
+	// inflight and maxInflight count the requests in flight at a time
+	inflight, maxInflight int
+}
+
+func (w *fakeWriter) Write(ctx context.Context, updates []*v1.RelationshipUpdate) error {
+	return w.request(ctx, func() { w.writes = append(w.writes, updates) })
+}
+
+func (w *fakeWriter) Delete(ctx context.Context, filter *v1.RelationshipFilter) error {
+	return w.request(ctx, func() { w.deletes = append(w.deletes, filter) })
+}
+
+func (w *fakeWriter) request(ctx context.Context, record func()) error {
+	w.Lock()
+	w.requests++
+	w.inflight++
+	if w.inflight > w.maxInflight {
+		w.maxInflight = w.inflight
+	}
+	delay := w.delay
+	w.Unlock()
+
+	var ctxErr error
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		// like a grpc client
+		ctxErr = status.FromContextError(ctx.Err()).Err()
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	w.inflight--
+	if ctxErr != nil {
+		return ctxErr
+	}
+	if len(w.errs) > 0 {
+		err := w.errs[0]
+		w.errs = w.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	record()
+	return nil
+}
+
+func touch(resourceID string) *v1.RelationshipUpdate {
+	return &v1.RelationshipUpdate{
+		Operation: v1.RelationshipUpdate_OPERATION_TOUCH,
+		Relationship: &v1.Relationship{
+			Resource: &v1.ObjectReference{ObjectType: "contact", ObjectId: resourceID},
+			Relation: "owner",
+			Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "1"}},
+		},
+	}
+}
+
+func touches(n int) []*v1.RelationshipUpdate {
+	updates := make([]*v1.RelationshipUpdate, 0, n)
+	for i := 0; i < n; i++ {
+		updates = append(updates, touch(fmt.Sprint(i)))
+	}
+	return updates
+}
+
+func batchSizes(writes [][]*v1.RelationshipUpdate) []int {
+	sizes := make([]int, 0, len(writes))
+	for _, w := range writes {
+		sizes = append(sizes, len(w))
+	}
+	return sizes
+}
+
+func TestBatchingRelationshipWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []*v1.RelationshipUpdate
+		sizes   []int
+	}{
+		{name: "nothing", updates: nil, sizes: []int{}},
+		{name: "smaller than a batch", updates: touches(3), sizes: []int{3}},
+		{name: "one batch", updates: touches(5), sizes: []int{5}},
+		{name: "exact multiple", updates: touches(10), sizes: []int{5, 5}},
+		{name: "final partial batch", updates: touches(12), sizes: []int{5, 5, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeWriter{}
+			w := NewBatchingRelationshipWriter(fake, 5, 1)
+			require.NoError(t, w.Write(context.Background(), tt.updates))
+			require.Equal(t, tt.sizes, batchSizes(fake.writes))
+
+			written := make([]*v1.RelationshipUpdate, 0, len(tt.updates))
+			for _, batch := range fake.writes {
+				written = append(written, batch...)
+			}
+			require.Equal(t, len(tt.updates), len(written))
+			for i := range written {
+				require.Same(t, tt.updates[i], written[i])
+			}
+		})
+	}
+}
+
+func TestBatchingRelationshipWriterDedupes(t *testing.T) {
+	first := touch("1")
+	deleted := touch("1")
+	deleted.Operation = v1.RelationshipUpdate_OPERATION_DELETE
+	other := touch("2")
+
+	fake := &fakeWriter{}
+	w := NewBatchingRelationshipWriter(fake, 2, 1)
+	require.NoError(t, w.Write(context.Background(), []*v1.RelationshipUpdate{first, other, deleted}))
+
+	// the last update to a relationship wins, and the batches are filled
+	// after merging
+	require.Equal(t, [][]*v1.RelationshipUpdate{{other, deleted}}, fake.writes)
+}
+
+func TestBatchingRelationshipWriterConcurrency(t *testing.T) {
+	fake := &fakeWriter{delay: 20 * time.Millisecond}
+	w := NewBatchingRelationshipWriter(fake, 2, 3)
+	require.NoError(t, w.Write(context.Background(), touches(20)))
+	require.Len(t, fake.writes, 10)
+	require.LessOrEqual(t, fake.maxInflight, 3)
+	require.Greater(t, fake.maxInflight, 1)
+}
+
+func TestBatchingRelationshipWriterError(t *testing.T) {
+	errWrite := errors.New("write failed")
+	fake := &fakeWriter{errs: []error{errWrite}}
+	w := NewBatchingRelationshipWriter(fake, 2, 1)
+	require.ErrorIs(t, w.Write(context.Background(), touches(6)), errWrite)
+	// no batches are written after the failed one
+	require.Empty(t, fake.writes)
+
+	fake = &fakeWriter{errs: []error{errWrite}, delay: time.Millisecond}
+	w = NewBatchingRelationshipWriter(fake, 2, 2)
+	require.ErrorIs(t, w.Write(context.Background(), touches(6)), errWrite)
+}
+
+func TestBatchingRelationshipWriterDisabled(t *testing.T) {
+	fake := &fakeWriter{}
+	require.Same(t, fake, NewBatchingRelationshipWriter(fake, 0, 4))
+}
+
+func TestLimitingRelationshipWriter(t *testing.T) {
+	fake := &fakeWriter{delay: 10 * time.Millisecond}
+	w := NewLimitingRelationshipWriter(fake, 2)
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				errs <- w.Write(context.Background(), touches(1))
+				return
+			}
+			errs <- w.Delete(context.Background(), &v1.RelationshipFilter{ResourceType: "contact"})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Len(t, fake.writes, 4)
+	require.Len(t, fake.deletes, 4)
+	require.Equal(t, 2, fake.maxInflight)
+}
@@ -0,0 +1,168 @@
+package write
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/authzed/connector-postgresql/pkg/metrics"
+)
+
+// RetryConfig configures a RetryingRelationshipWriter
+type RetryConfig struct {
+	// MaxAttempts is the number of times a request is tried, 0 tries until
+	// MaxElapsedTime has passed
+	MaxAttempts int
+	// AttemptTimeout limits how long a single attempt can take, 0 doesn't
+	// limit it
+	AttemptTimeout time.Duration
+	// MaxElapsedTime limits how long a request is retried for, 0 retries
+	// until MaxAttempts is reached
+	MaxElapsedTime time.Duration
+	// InitialInterval and MaxInterval bound the wait between attempts, which
+	// grows exponentially and is randomized by half in either direction
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+}
+
+// DefaultRetryConfig returns the RetryConfig used by the commands
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:     5,
+		AttemptTimeout:  30 * time.Second,
+		MaxElapsedTime:  time.Minute,
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     10 * time.Second,
+	}
+}
+
+func (c RetryConfig) backOff(ctx context.Context) backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = c.InitialInterval
+	b.MaxInterval = c.MaxInterval
+	b.MaxElapsedTime = c.MaxElapsedTime
+	b.RandomizationFactor = 0.5
+	b.Reset()
+	var bo backoff.BackOff = b
+	if c.MaxAttempts > 0 {
+		bo = backoff.WithMaxRetries(bo, uint64(c.MaxAttempts-1))
+	}
+	return backoff.WithContext(bo, ctx)
+}
+
+// errorClass is what a RetryingRelationshipWriter does with an error
+type errorClass int
+
+const (
+	// failed errors are returned to the caller
+	failed errorClass = iota
+	// retryable errors are retried with backoff
+	retryable
+	// rejected errors mean the request can never succeed, and are sent to
+	// the dead letter path
+	rejected
+)
+
+func classify(ctx context.Context, err error) errorClass {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return retryable
+	case codes.DeadlineExceeded:
+		// the attempt timed out, but the caller still has time
+		if ctx.Err() == nil {
+			return retryable
+		}
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		return rejected
+	}
+	return failed
+}
+
+// NewRetryingRelationshipWriter retries requests to writer that fail with
+// Unavailable or ResourceExhausted, with exponential backoff. Requests
+// rejected with InvalidArgument or FailedPrecondition are never retried but
+// sent to deadLetter, and then count as written.
+func NewRetryingRelationshipWriter(writer RelationshipWriter, config RetryConfig, deadLetter DeadLetter) RelationshipWriter {
+	if deadLetter == nil {
+		deadLetter = LoggingDeadLetter{}
+	}
+	return RetryingRelationshipWriter{
+		writer:     writer,
+		config:     config,
+		deadLetter: deadLetter,
+	}
+}
+
+// RetryingRelationshipWriter retries failed requests to an underlying
+// RelationshipWriter
+type RetryingRelationshipWriter struct {
+	writer     RelationshipWriter
+	config     RetryConfig
+	deadLetter DeadLetter
+}
+
+func (w RetryingRelationshipWriter) Write(ctx context.Context, updates []*v1.RelationshipUpdate) error {
+	err := w.retry(ctx, "WriteRelationships", func(ctx context.Context) error {
+		return w.writer.Write(ctx, updates)
+	})
+	var rej rejectedError
+	if errors.As(err, &rej) {
+		return w.deadLetter.Add(ctx, NewLetter(rej.err, updates, nil))
+	}
+	return err
+}
+
+func (w RetryingRelationshipWriter) Delete(ctx context.Context, filter *v1.RelationshipFilter) error {
+	err := w.retry(ctx, "DeleteRelationships", func(ctx context.Context) error {
+		return w.writer.Delete(ctx, filter)
+	})
+	var rej rejectedError
+	if errors.As(err, &rej) {
+		return w.deadLetter.Add(ctx, NewLetter(rej.err, nil, filter))
+	}
+	return err
+}
+
+// rejectedError wraps errors that should go to the dead letter path
+type rejectedError struct {
+	err error
+}
+
+func (e rejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (w RetryingRelationshipWriter) retry(ctx context.Context, method string, attempt func(context.Context) error) error {
+	operation := func() error {
+		attemptCtx := ctx
+		if w.config.AttemptTimeout > 0 {
+			var cancel context.CancelFunc
+			attemptCtx, cancel = context.WithTimeout(ctx, w.config.AttemptTimeout)
+			defer cancel()
+		}
+		err := attempt(attemptCtx)
+		switch classify(ctx, err) {
+		case retryable:
+			return err
+		case rejected:
+			metrics.DeadLetters.WithLabelValues(method).Inc()
+			return backoff.Permanent(rejectedError{err: err})
+		default:
+			if err == nil {
+				return nil
+			}
+			return backoff.Permanent(err)
+		}
+	}
+	notify := func(err error, wait time.Duration) {
+		metrics.RequestRetries.WithLabelValues(method, status.Code(err).String()).Inc()
+		log.Warn().Err(err).Str("method", method).Dur("wait", wait).Msg("request to SpiceDB failed, retrying")
+	}
+	return backoff.RetryNotify(operation, w.config.backOff(ctx), notify)
+}
@@ -0,0 +1,192 @@
+package write
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recordingDeadLetter keeps the letters it gets
+type recordingDeadLetter struct {
+	sync.Mutex
+	letters []Letter
+}
+
+func (d *recordingDeadLetter) Add(ctx context.Context, l Letter) error {
+	d.Lock()
+	defer d.Unlock()
+	d.letters = append(d.letters, l)
+	return nil
+}
+
+func testRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:     3,
+		MaxElapsedTime:  time.Second,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond,
+	}
+}
+
+func TestClassify(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		err   error
+		class errorClass
+	}{
+		{name: "unavailable", err: status.Error(codes.Unavailable, ""), class: retryable},
+		{name: "resource exhausted", err: status.Error(codes.ResourceExhausted, ""), class: retryable},
+		{name: "attempt timed out", err: status.Error(codes.DeadlineExceeded, ""), class: retryable},
+		{name: "caller timed out", ctx: canceled, err: status.Error(codes.DeadlineExceeded, ""), class: failed},
+		{name: "invalid argument", err: status.Error(codes.InvalidArgument, ""), class: rejected},
+		{name: "failed precondition", err: status.Error(codes.FailedPrecondition, ""), class: rejected},
+		{name: "permission denied", err: status.Error(codes.PermissionDenied, ""), class: failed},
+		{name: "internal", err: status.Error(codes.Internal, ""), class: failed},
+		{name: "not grpc", err: errors.New("boom"), class: failed},
+		{name: "no error", err: nil, class: failed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			require.Equal(t, tt.class, classify(ctx, tt.err))
+		})
+	}
+}
+
+func TestRetryingRelationshipWriter(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	tests := []struct {
+		name     string
+		errs     []error
+		err      error
+		attempts int
+		written  bool
+	}{
+		{name: "succeeds", attempts: 1, written: true},
+		{name: "retries until it succeeds", errs: []error{unavailable, unavailable}, attempts: 3, written: true},
+		{name: "gives up after max attempts", errs: []error{unavailable, unavailable, unavailable, nil}, err: unavailable, attempts: 3},
+		{name: "doesn't retry other errors", errs: []error{status.Error(codes.PermissionDenied, "denied")}, err: status.Error(codes.PermissionDenied, "denied"), attempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeWriter{errs: tt.errs}
+			dl := &recordingDeadLetter{}
+			w := NewRetryingRelationshipWriter(fake, testRetryConfig(), dl)
+			err := w.Write(context.Background(), touches(1))
+			if tt.err != nil {
+				require.Equal(t, status.Code(tt.err), status.Code(err))
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.attempts, fake.requests)
+			require.Equal(t, tt.written, len(fake.writes) == 1)
+			require.Empty(t, dl.letters)
+		})
+	}
+}
+
+func TestRetryingRelationshipWriterMaxElapsedTime(t *testing.T) {
+	errs := make([]error, 1000)
+	for i := range errs {
+		errs[i] = status.Error(codes.Unavailable, "unavailable")
+	}
+	fake := &fakeWriter{errs: errs}
+	config := testRetryConfig()
+	config.MaxAttempts = 0
+	config.MaxElapsedTime = 50 * time.Millisecond
+	config.InitialInterval = 10 * time.Millisecond
+	config.MaxInterval = 10 * time.Millisecond
+
+	start := time.Now()
+	err := NewRetryingRelationshipWriter(fake, config, nil).Write(context.Background(), touches(1))
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Less(t, time.Since(start), time.Second)
+	require.Greater(t, fake.requests, 1)
+	require.Less(t, fake.requests, 20)
+}
+
+func TestRetryingRelationshipWriterTimeouts(t *testing.T) {
+	config := testRetryConfig()
+	config.AttemptTimeout = 10 * time.Millisecond
+
+	// attempts that time out are retried
+	fake := &fakeWriter{delay: time.Hour}
+	err := NewRetryingRelationshipWriter(fake, config, nil).Write(context.Background(), touches(1))
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.Equal(t, 3, fake.requests)
+
+	// but not once the caller's time is up
+	fake = &fakeWriter{delay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	err = NewRetryingRelationshipWriter(fake, config, nil).Write(ctx, touches(1))
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.Equal(t, 1, fake.requests)
+	require.Empty(t, fake.writes)
+}
+
+func TestRetryingRelationshipWriterDeadLetters(t *testing.T) {
+	invalid := status.Error(codes.InvalidArgument, "no such relation")
+	fake := &fakeWriter{errs: []error{invalid, invalid}}
+	dl := &recordingDeadLetter{}
+	w := NewRetryingRelationshipWriter(fake, testRetryConfig(), dl)
+
+	// rejected requests aren't retried, and count as written
+	require.NoError(t, w.Write(context.Background(), touches(2)))
+	require.NoError(t, w.Delete(context.Background(), &v1.RelationshipFilter{ResourceType: "contact", OptionalRelation: "owner"}))
+	require.Equal(t, 2, fake.requests)
+	require.Empty(t, fake.writes)
+	require.Empty(t, fake.deletes)
+
+	require.Len(t, dl.letters, 2)
+	require.Equal(t, "InvalidArgument", dl.letters[0].Code)
+	require.Equal(t, invalid.Error(), dl.letters[0].Error)
+	require.Equal(t, []string{
+		"OPERATION_TOUCH contact:0#owner@user:1",
+		"OPERATION_TOUCH contact:1#owner@user:1",
+	}, dl.letters[0].Updates)
+	require.Empty(t, dl.letters[0].Filter)
+	require.Empty(t, dl.letters[1].Updates)
+	require.NotEmpty(t, dl.letters[1].Filter)
+}
+
+func TestFileDeadLetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	d := NewFileDeadLetter(path)
+	invalid := status.Error(codes.FailedPrecondition, "precondition failed")
+	require.NoError(t, d.Add(context.Background(), NewLetter(invalid, touches(1), nil)))
+	require.NoError(t, d.Add(context.Background(), NewLetter(invalid, nil, &v1.RelationshipFilter{ResourceType: "contact"})))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	letters := make([]Letter, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var l Letter
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &l))
+		letters = append(letters, l)
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, letters, 2)
+	require.Equal(t, "FailedPrecondition", letters[0].Code)
+	require.Equal(t, []string{"OPERATION_TOUCH contact:0#owner@user:1"}, letters[0].Updates)
+	require.NotEmpty(t, letters[1].Filter)
+}